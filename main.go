@@ -2,8 +2,11 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/sha256"
 	"debug/buildinfo"
 	"encoding/csv"
@@ -11,65 +14,189 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/estargz/zstdchunked"
 	_ "github.com/glebarez/go-sqlite" // SQLite driver for RPM DB
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	rpmdb "github.com/knqyf263/go-rpmdb/pkg"
+	"gopkg.in/yaml.v3"
 )
 
-const version = "0.12.5"
+const version = "0.37.2"
 
-// Default concurrency limit for parallel image analysis
+// Process exit codes
+const (
+	exitFailure            = 1   // fatal error, or every image failed
+	exitPartialFailure     = 2   // some images failed; results shown for the rest
+	exitPolicyViolation    = 3   // every image analyzed, but at least one violates --policy
+	exitBaselineRegression = 4   // check found growth or new packages against the baseline
+	exitDiffChanged        = 5   // diff --fail-on-change found changed packages
+	exitInterrupted        = 130 // cancelled by SIGINT/SIGTERM, like a shell reports it
+)
+
+// Default file written by snapshot
+const defaultBaselinePath = "pkgpulse.baseline.json"
+
+// Default concurrency limit for parallel image analysis (--concurrency)
 const defaultConcurrency = 5
 
+// errInterrupted cancels in-flight work on SIGINT/SIGTERM
+var errInterrupted = errors.New("interrupted")
+
+// Default cap on file contents buffered in memory across parallel analyses (--max-memory)
+const defaultMemoryLimit = 256 << 20
+
+// Longest signature (e.g. "BusyBox v1.36.1") findSignature is guaranteed to find
+const signatureOverlap = 256
+
+// Version of the native parsers' output. Bump it whenever a parser change alters the
+// packages or sizes reported, so analysis results cached by older versions are redone.
+const parserVersion = 6
+
+// Environment variable with a cache size limit (e.g. 10GB) enforced after every cache write
+const cacheMaxSizeEnv = "PKGPULSE_CACHE_MAX_SIZE"
+
+// Cross-process cache locks: holders refresh the lock file's mtime every heartbeat, so a
+// lock that hasn't been touched for cacheLockStale was left by a process that died
+const (
+	cacheLockPoll      = 100 * time.Millisecond
+	cacheLockHeartbeat = 5 * time.Second
+	cacheLockStale     = time.Minute
+)
+
+// errCorruptCacheBlob marks a cached blob whose content doesn't match its digest
+var errCorruptCacheBlob = errors.New("corrupt cache blob")
+
+// Source column values for cache hits, depending on whether the tag was confirmed unchanged
+const (
+	sourceCachedFresh = "cached (fresh)"
+	sourceCachedStale = "cached (stale)"
+)
+
 // Catalogers to use for syft fallback (skip language-specific ones for speed)
-const defaultCatalogers = "apk,dpkg,rpm,binary"
+const defaultCatalogers = "apk,dpkg,rpm,alpm,binary"
 
 // Package database paths
 const (
-	apkDBPath       = "lib/apk/db/installed"
-	dpkgDBPath      = "var/lib/dpkg/status"
-	dpkgStatusDir   = "var/lib/dpkg/status.d"
-	rpmDBPathSqlite = "var/lib/rpm/rpmdb.sqlite"
-	rpmDBPathBDB    = "var/lib/rpm/Packages"
-	rpmDBPathNDB    = "var/lib/rpm/Packages.db"
+	apkDBPath      = "lib/apk/db/installed"
+	dpkgDBPath     = "var/lib/dpkg/status"
+	dpkgStatusDir  = "var/lib/dpkg/status.d"
+	pacmanLocalDir = "var/lib/pacman/local" // one <name>-<version>/desc per package
 )
 
+// RPM database directories, most current first. usr/lib/sysimage/rpm is the default on
+// Fedora 36+, openSUSE and newer UBI/Amazon Linux releases, usually with var/lib/rpm a
+// symlink to it; usr/share/rpm is used by older SUSE releases.
+var rpmDBDirs = []string{"usr/lib/sysimage/rpm", "var/lib/rpm", "usr/share/rpm"}
+
+// RPM database files, newest format first
+var rpmDBFiles = []struct{ name, format string }{
+	{"rpmdb.sqlite", "sqlite"},
+	{"Packages.db", "ndb"},
+	{"Packages", "bdb"},
+}
+
+// Directories whose executables are inspected for binary packages
+var binaryCandidateDirs = []string{"usr/bin", "usr/local/bin", "bin", "usr/sbin", "sbin"}
+
+// Local image source prefixes (analyzed without a registry or cache)
+const (
+	ociLayoutPrefix     = "oci:"
+	dockerArchivePrefix = "docker-archive:"
+	rootfsDirPrefix     = "dir:"
+)
+
+// OCI layout annotation holding the tag of each manifest in index.json
+const ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+
 var busyBoxVersionRe = regexp.MustCompile(`BusyBox v([0-9][0-9A-Za-z.+~:_-]*)`)
 var debianGLIBCVersionRe = regexp.MustCompile(`\(Debian GLIBC ([^)]+)\)`)
 var glibcSymbolVersionRe = regexp.MustCompile(`GLIBC_([0-9]+(?:\.[0-9]+){1,2})`)
 
-// Cache metadata stored alongside tarball
+// Cache pointer from an image ref (and platform) to its manifest in the blob store
 type cacheEntry struct {
-	ImageRef  string    `json:"image_ref"`
-	Digest    string    `json:"digest"`
-	CachedAt  time.Time `json:"cached_at"`
-	SizeBytes int64     `json:"size_bytes"`
+	ImageRef    string    `json:"image_ref"`
+	Platform    string    `json:"platform,omitempty"`
+	Digest      string    `json:"digest"`               // image manifest in the blob store
+	TagDigest   string    `json:"tag_digest,omitempty"` // what the ref resolved to; an index for multi-platform images
+	CachedAt    time.Time `json:"cached_at"`
+	ValidatedAt time.Time `json:"validated_at,omitempty"` // last time the registry confirmed TagDigest
+	LastUsedAt  time.Time `json:"last_used_at,omitempty"` // last cache hit, for LRU eviction
+	SizeBytes   int64     `json:"size_bytes"`             // manifest, config and layer blobs, shared or not
+}
+
+// packageDatabases holds the final-state package database files of a filesystem
+type packageDatabases struct {
+	apk             *spooledFile
+	dpkg            *spooledFile
+	dpkgStatusParts map[string]*spooledFile
+	rpm             *spooledFile            // always on disk, as go-rpmdb opens a path
+	rpmFormat       string                  // "sqlite", "bdb", or "ndb"
+	pacman          map[string]*spooledFile // desc files by path
+}
+
+func (dbs packageDatabases) close() {
+	_ = dbs.apk.Close()
+	_ = dbs.dpkg.Close()
+	_ = dbs.rpm.Close()
+	for _, part := range dbs.dpkgStatusParts {
+		_ = part.Close()
+	}
+	for _, desc := range dbs.pacman {
+		_ = desc.Close()
+	}
 }
 
 /* ---- Native package representation ---- */
 type pkg struct {
-	Name    string
-	Version string
-	SizeKB  int64
-	Type    string // "apk", "deb", "rpm", "binary"
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	SizeKB  int64  `json:"size_kb"`
+	Type    string `json:"type"` // "apk", "deb", "rpm", "pacman", "binary", "python", "npm", "java"
+	Arch    string `json:"arch,omitempty"`
+	License string `json:"license,omitempty"`
+
+	// Every version of a language package installed at several versions, oldest first;
+	// Version is then the newest
+	Versions []string `json:"versions,omitempty"`
+}
+
+// analysisCacheEntry is the native analysis of one image, stored per manifest digest
+type analysisCacheEntry struct {
+	ParserVersion int      `json:"parser_version"`
+	Digest        string   `json:"digest"`
+	Languages     []string `json:"languages,omitempty"` // language packages included (--languages)
+	Packages      []pkg    `json:"packages"`
 }
 
 /* ---- Minimal Syft JSON we need (syft-json schema) - for fallback ---- */
@@ -87,7 +214,7 @@ type syftArtifact struct {
 }
 type syftMetadata struct {
 	InstalledSize int64 `json:"installedSize"` // KB for deb
-	Size          int64 `json:"size"`          // bytes for rpm and apk
+	Size          int64 `json:"size"`          // bytes for rpm, apk and alpm
 }
 type syftRelationship struct {
 	Parent string `json:"parent"`
@@ -104,18 +231,72 @@ type syftFileMetadata struct {
 
 /* ---- Package row for output ---- */
 type row struct {
-	Name, Ver string
-	MB        float64
+	Name, Ver     string
+	Vers          []string // all versions, oldest first, when copies differ (see pkg.Versions)
+	MB            float64
+	Type          string
+	SizeKB        int64
+	Arch, License string // when the package database records them
+}
+
+// packageKey identifies a package when results are compared. Each language ecosystem
+// is a namespace of its own, so a python "six" and an apk "six" in one image stay
+// apart; OS packages share one, so images of different distros still line up by name.
+type packageKey struct {
+	Ecosystem string // the language package type, or "" for OS packages and binaries
+	Name      string
+}
+
+func rowKey(r row) packageKey {
+	if slices.Contains(supportedLanguages, r.Type) {
+		return packageKey{Ecosystem: r.Type, Name: r.Name}
+	}
+	return packageKey{Name: r.Name}
+}
+
+// String names the package in tables: "six", or "six (python)" for a language package
+func (k packageKey) String() string {
+	if k.Ecosystem == "" {
+		return k.Name
+	}
+	return k.Name + " (" + k.Ecosystem + ")"
+}
+
+func comparePackageKeys(a, b packageKey) int {
+	return cmp.Or(strings.Compare(a.Name, b.Name), strings.Compare(a.Ecosystem, b.Ecosystem))
+}
+
+// imageJob is one image to analyze, optionally pinned to a platform
+type imageJob struct {
+	Image    string
+	Platform *v1.Platform
 }
 
 type imageResult struct {
 	Image        string
+	Platform     string // set when a platform was requested or expanded
+	Digest       string // manifest digest, empty when not cheaply known (archives, dirs)
+	Err          error  // set when analysis failed; other fields are mostly empty
 	CompressedMB float64
 	InstalledMB  float64
 	PackageCount int
 	Rows         []row
-	PackageMap   map[string]row
-	Source       string // "local" or "remote"
+	PackageMap   map[packageKey]row
+	AllRows      []row  // every parsed package, including the zero-size ones (meta-packages) Rows leaves out
+	Source       string // "remote", "cached (fresh)", "cached (stale)", or a local source kind
+
+	// Set by --manifest-only, which reads the manifest and config instead of parsing packages
+	ManifestOnly bool
+	LayerCount   int
+	Created      time.Time // zero when the config has no creation date
+	Architecture string    // config platform, e.g. "linux/arm64"
+}
+
+// localImageRef describes an image read from disk instead of a registry
+type localImageRef struct {
+	Kind string // "oci", "archive" or "dir"
+	Path string
+	Tag  string
 }
 
 type progressEvent struct {
@@ -154,6 +335,20 @@ func (p *progressReadCloser) Read(b []byte) (int, error) {
 	return n, err
 }
 
+// contextReadCloser fails reads once ctx is done, so reads of local files (cached layers)
+// stop on cancellation like registry requests do
+type contextReadCloser struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+func (r contextReadCloser) Read(b []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.ReadCloser.Read(b)
+}
+
 type progressTransport struct {
 	base    http.RoundTripper
 	onBytes func(int64)
@@ -189,8 +384,14 @@ func stageLabel(stage string) string {
 		return "resolving image"
 	case "cache_load":
 		return "loading cache"
+	case "cache_check":
+		return "revalidating cache"
+	case "local_load":
+		return "loading local image"
 	case "manifest":
 		return "fetching manifest"
+	case "config":
+		return "reading config"
 	case "downloading":
 		return "downloading"
 	case "cache_save":
@@ -205,6 +406,8 @@ func stageLabel(stage string) string {
 		return "processing output"
 	case "done":
 		return "done"
+	case "failed":
+		return "FAILED"
 	default:
 		return stage
 	}
@@ -301,14 +504,231 @@ func runProgressRenderer(progressChan <-chan progressEvent, total int, done chan
 	done <- struct{}{}
 }
 
+// JSON report schema. Bump jsonSchemaVersion on any breaking change
+// (renamed/removed fields or changed meaning); adding fields is non-breaking.
+const jsonSchemaVersion = 1
+
+type jsonReport struct {
+	SchemaVersion int             `json:"schema_version"`
+	Report        string          `json:"report"` // "analysis" or "snapshot"
+	Tool          string          `json:"tool"`
+	ToolVersion   string          `json:"tool_version"`
+	GeneratedAt   time.Time       `json:"generated_at"`
+	Images        []jsonImage     `json:"images"`
+	Comparison    *jsonComparison `json:"comparison,omitempty"` // only for multi-image runs
+	Policy        *jsonPolicy     `json:"policy,omitempty"`     // only with --policy
+}
+
+type jsonImage struct {
+	Image        string        `json:"image"`
+	Platform     string        `json:"platform,omitempty"`
+	Digest       string        `json:"digest,omitempty"`
+	Source       string        `json:"source"`
+	Error        string        `json:"error,omitempty"` // analysis failure; sizes and packages are empty
+	CompressedMB float64       `json:"compressed_mb"`   // 0 when unknown (archives, dirs)
+	InstalledMB  float64       `json:"installed_mb"`
+	PackageCount int           `json:"package_count"`
+	Packages     []jsonPackage `json:"packages"`
+	ManifestOnly bool          `json:"manifest_only,omitempty"` // packages were not parsed; installed_mb is 0
+	LayerCount   int           `json:"layer_count,omitempty"`   // only with --manifest-only
+	Created      *time.Time    `json:"created,omitempty"`       // only with --manifest-only
+	Architecture string        `json:"architecture,omitempty"`  // only with --manifest-only
+}
+
+type jsonPackage struct {
+	Name        string  `json:"name"`
+	Version     string  `json:"version"`
+	Type        string  `json:"type"`
+	InstalledKB int64   `json:"installed_kb"`
+	InstalledMB float64 `json:"installed_mb"`
+	Arch        string  `json:"arch,omitempty"`
+	License     string  `json:"license,omitempty"`
+
+	// Set when copies of the package are installed at different versions, oldest first;
+	// version is the newest of them
+	Versions []string `json:"versions,omitempty"`
+}
+
+type jsonComparison struct {
+	Images   []string            `json:"images"` // column order for every row's cells
+	Packages []jsonComparisonRow `json:"packages"`
+}
+
+type jsonComparisonRow struct {
+	Name  string               `json:"name"`
+	Cells []jsonComparisonCell `json:"cells"`
+}
+
+type jsonComparisonCell struct {
+	Present     bool    `json:"present"`
+	Type        string  `json:"type,omitempty"`
+	Version     string  `json:"version,omitempty"`
+	InstalledMB float64 `json:"installed_mb,omitempty"`
+	Newest      bool    `json:"newest,omitempty"` // newest version when versions differ across images
+}
+
+type jsonPolicy struct {
+	File   string            `json:"file"`
+	Passed bool              `json:"passed"`
+	Images []jsonPolicyImage `json:"images"` // failed images are not evaluated and omitted
+}
+
+type jsonPolicyImage struct {
+	Image      string                `json:"image"`
+	Platform   string                `json:"platform,omitempty"`
+	Passed     bool                  `json:"passed"`
+	Violations []jsonPolicyViolation `json:"violations"`
+	Skipped    []string              `json:"skipped,omitempty"` // rules that could not be evaluated
+}
+
+type jsonPolicyViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type jsonDiffReport struct {
+	SchemaVersion int                 `json:"schema_version"`
+	Report        string              `json:"report"` // "diff" or "check"
+	Tool          string              `json:"tool"`
+	ToolVersion   string              `json:"tool_version"`
+	GeneratedAt   time.Time           `json:"generated_at"`
+	Old           jsonImage           `json:"old"`
+	New           jsonImage           `json:"new"`
+	Summary       jsonDiffSummary     `json:"summary"`
+	Changes       []jsonPackageChange `json:"changes"`
+	Check         *jsonCheck          `json:"check,omitempty"` // only for "check" reports
+}
+
+type jsonDiffSummary struct {
+	CompressedDeltaMB *float64 `json:"compressed_delta_mb"` // null when either compressed size is unknown
+	InstalledDeltaMB  float64  `json:"installed_delta_mb"`
+	PackageCountDelta int      `json:"package_count_delta"`
+	Added             int      `json:"added"`
+	Removed           int      `json:"removed"`
+	Upgraded          int      `json:"upgraded"`
+	Downgraded        int      `json:"downgraded"`
+	SizeChanged       int      `json:"size_changed"`
+	Unchanged         int      `json:"unchanged"`
+}
+
+type jsonCheck struct {
+	Baseline          string                `json:"baseline"`
+	Passed            bool                  `json:"passed"`
+	Tolerance         string                `json:"tolerance"` // as given, e.g. "5%" or "2MB"
+	AllowedGrowthMB   float64               `json:"allowed_growth_mb"`
+	InstalledGrowthMB float64               `json:"installed_growth_mb"`
+	Regressions       []jsonCheckRegression `json:"regressions"`
+}
+
+type jsonCheckRegression struct {
+	Rule    string `json:"rule"` // "installed_size" or "new_package"
+	Message string `json:"message"`
+}
+
+type jsonPackageChange struct {
+	Change         string  `json:"change"`
+	Name           string  `json:"name"`
+	Type           string  `json:"type"`
+	OldVersion     string  `json:"old_version,omitempty"`
+	NewVersion     string  `json:"new_version,omitempty"`
+	OldInstalledMB float64 `json:"old_installed_mb"`
+	NewInstalledMB float64 `json:"new_installed_mb"`
+	DeltaMB        float64 `json:"delta_installed_mb"`
+}
+
+// Package change kinds reported by diff, in display order
+const (
+	changeAdded       = "added"
+	changeRemoved     = "removed"
+	changeUpgraded    = "upgraded"
+	changeDowngraded  = "downgraded"
+	changeSizeChanged = "size-changed"
+)
+
+var changeKindOrder = []string{changeAdded, changeRemoved, changeUpgraded, changeDowngraded, changeSizeChanged}
+
+type packageChange struct {
+	Kind       string
+	Key        packageKey
+	Type       string // of the new package, or the old one when removed
+	OldVersion string
+	NewVersion string
+	OldMB      float64
+	NewMB      float64
+}
+
+type imageDiff struct {
+	Old       imageResult
+	New       imageResult
+	Changes   []packageChange
+	Unchanged int
+}
+
+// policy is a size budget and package allow/deny list checked against every analyzed image.
+// Unset limits are not checked; package entries are exact names or path.Match globs.
+type policy struct {
+	MaxCompressedMB   *float64 `json:"max_compressed_mb" yaml:"max_compressed_mb"`
+	MaxInstalledMB    *float64 `json:"max_installed_mb" yaml:"max_installed_mb"`
+	MaxPackages       *int     `json:"max_packages" yaml:"max_packages"`
+	ForbiddenPackages []string `json:"forbidden_packages" yaml:"forbidden_packages"`
+	RequiredPackages  []string `json:"required_packages" yaml:"required_packages"`
+
+	// Oldest allowed version of each matching package, compared by its ecosystem's rules
+	MinVersions map[string]string `json:"min_versions" yaml:"min_versions"`
+}
+
+type policyViolation struct {
+	Rule    string // policy key that was broken, e.g. "max_installed_mb"
+	Message string
+}
+
+type policyResult struct {
+	Image      string
+	Platform   string
+	Violations []policyViolation
+	Skipped    []string // rules that could not be evaluated, with the reason
+}
+
+// policyEvaluation is the outcome of --policy for one run
+type policyEvaluation struct {
+	Path    string
+	Results []policyResult
+}
+
+// sizeTolerance is how much installed size may grow before check fails
+type sizeTolerance struct {
+	Value   float64
+	Percent bool // Value is a percentage of the baseline installed size, otherwise MB
+}
+
+type checkRegression struct {
+	Rule    string // "installed_size" or "new_package"
+	Message string
+}
+
+// baselineCheck is the verdict of check against a snapshot
+type baselineCheck struct {
+	BaselinePath    string
+	Tolerance       sizeTolerance
+	AllowedGrowthMB float64
+	GrowthMB        float64
+	Regressions     []checkRegression
+}
+
 type comparisonCell struct {
 	Version string
 	MB      float64
+	Type    string
 	Present bool
+	Newest  bool // carries the newest version of a package that differs across images
 }
 
 /* ---- Cache functions ---- */
 
+// The cache directory is an OCI image layout. Manifests, configs and compressed layers
+// live once under blobs/<alg>/<hex> and are shared by every cached image; refs/ holds
+// one cacheEntry per image ref (and platform) pointing at its manifest.
+
 func getCacheDir() string {
 	cacheDir := os.Getenv("XDG_CACHE_HOME")
 	if cacheDir == "" {
@@ -326,1144 +746,6217 @@ func hashImageRef(ref string) string {
 	return hex.EncodeToString(h[:8]) // First 8 bytes = 16 hex chars
 }
 
-func getCachePaths(imageRef string) (tarPath, metaPath string) {
+// getCacheRefPath returns the manifest pointer path for an image ref.
+// A non-empty platform gets its own pointer so per-arch pulls don't overwrite each other.
+func getCacheRefPath(imageRef, platform string) string {
 	cacheDir := getCacheDir()
 	if cacheDir == "" {
-		return "", ""
+		return ""
 	}
-	hash := hashImageRef(imageRef)
-	safeName := strings.ReplaceAll(imageRef, "/", "_")
+	key := imageRef
+	if platform != "" {
+		key = imageRef + "_" + platform
+	}
+	hash := hashImageRef(key)
+	safeName := strings.ReplaceAll(key, "/", "_")
 	safeName = strings.ReplaceAll(safeName, ":", "_")
-	baseName := fmt.Sprintf("%s_%s", safeName, hash)
-	return filepath.Join(cacheDir, baseName+".tar"), filepath.Join(cacheDir, baseName+".json")
+	return filepath.Join(cacheDir, "refs", fmt.Sprintf("%s_%s.json", safeName, hash))
 }
 
-func loadFromCache(imageRef string, logProgress func(string)) (v1.Image, *cacheEntry, bool) {
-	tarPath, metaPath := getCachePaths(imageRef)
-	if tarPath == "" {
-		return nil, nil, false
-	}
+func cacheBlobPath(h v1.Hash) string {
+	return filepath.Join(getCacheDir(), "blobs", h.Algorithm, h.Hex)
+}
 
-	// Check if cache files exist
-	if _, err := os.Stat(tarPath); os.IsNotExist(err) {
-		return nil, nil, false
-	}
-	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
-		return nil, nil, false
+func readCacheEntry(path string) (cacheEntry, error) {
+	var entry cacheEntry
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return entry, err
 	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
 
-	// Load metadata
-	metaData, err := os.ReadFile(metaPath)
-	if err != nil {
+func loadFromCache(imageRef, platform string, logProgress func(string)) (v1.Image, *cacheEntry, bool) {
+	refPath := getCacheRefPath(imageRef, platform)
+	if refPath == "" {
 		return nil, nil, false
 	}
-	var entry cacheEntry
-	if err := json.Unmarshal(metaData, &entry); err != nil {
+	entry, err := readCacheEntry(refPath)
+	if err != nil {
 		return nil, nil, false
 	}
 
-	// Load image from tarball
 	logProgress("Loading from cache...")
-	img, err := tarball.ImageFromPath(tarPath, nil)
+	img, err := loadCachedImage(entry.Digest)
 	if err != nil {
 		logProgress(fmt.Sprintf("Cache read failed: %v", err))
 		return nil, nil, false
 	}
 
+	entry.LastUsedAt = time.Now()
+	_ = touchCacheEntry(refPath, entry.Digest, func(e *cacheEntry) { e.LastUsedAt = entry.LastUsedAt })
 	return img, &entry, true
 }
 
-func saveToCache(imageRef string, img v1.Image, logProgress func(string)) error {
-	tarPath, metaPath := getCachePaths(imageRef)
-	if tarPath == "" {
-		return fmt.Errorf("could not determine cache directory")
+// loadCachedImage opens an image from the blob store by manifest digest. Every blob the
+// manifest references must be present, so a half-written or pruned image is a miss.
+func loadCachedImage(digest string) (v1.Image, error) {
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		return nil, err
 	}
-
-	// Ensure cache directory exists
-	cacheDir := getCacheDir()
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return fmt.Errorf("create cache dir: %w", err)
+	raw, err := readVerifiedCacheBlob(h)
+	if err != nil {
+		return nil, err
 	}
-
-	logProgress("Saving to cache...")
-
-	// Get image digest
-	digest, err := img.Digest()
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
 	if err != nil {
-		return fmt.Errorf("get digest: %w", err)
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if _, err := readVerifiedCacheBlob(manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	// Layers are too big to hash on every load: check sizes here (catching truncated
+	// writes) and digests as they are read, see cachedLayer.Compressed
+	for _, desc := range manifest.Layers {
+		info, err := os.Stat(cacheBlobPath(desc.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("missing blob %s", desc.Digest)
+		}
+		if info.Size() != desc.Size {
+			_ = os.Remove(cacheBlobPath(desc.Digest))
+			return nil, fmt.Errorf("%w %s: size %d, expected %d", errCorruptCacheBlob, desc.Digest, info.Size(), desc.Size)
+		}
 	}
+	markCacheDigestInUse(h)
+	return partial.CompressedToImage(&cachedImage{rawManifest: raw, manifest: manifest})
+}
 
-	// Write tarball
-	ref, err := name.ParseReference(imageRef)
-	if err != nil {
-		return fmt.Errorf("parse ref: %w", err)
+// cachedImage serves an image straight from the blob store
+type cachedImage struct {
+	rawManifest []byte
+	manifest    *v1.Manifest
+}
+
+func (c *cachedImage) RawManifest() ([]byte, error) { return c.rawManifest, nil }
+
+func (c *cachedImage) MediaType() (types.MediaType, error) {
+	if c.manifest.MediaType != "" {
+		return c.manifest.MediaType, nil
 	}
-	if err := tarball.WriteToFile(tarPath, ref, img); err != nil {
-		return fmt.Errorf("write tarball: %w", err)
+	return types.OCIManifestSchema1, nil
+}
+
+func (c *cachedImage) RawConfigFile() ([]byte, error) {
+	return readVerifiedCacheBlob(c.manifest.Config.Digest)
+}
+
+func (c *cachedImage) LayerByDigest(h v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range c.manifest.Layers {
+		if desc.Digest == h {
+			return &cachedLayer{desc: desc}, nil
+		}
 	}
+	return nil, fmt.Errorf("layer %s not in manifest", h)
+}
+
+type cachedLayer struct {
+	desc v1.Descriptor
+}
 
-	// Get file size
-	info, err := os.Stat(tarPath)
+func (l *cachedLayer) Digest() (v1.Hash, error)            { return l.desc.Digest, nil }
+func (l *cachedLayer) Size() (int64, error)                { return l.desc.Size, nil }
+func (l *cachedLayer) MediaType() (types.MediaType, error) { return l.desc.MediaType, nil }
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	f, err := os.Open(cacheBlobPath(l.desc.Digest))
 	if err != nil {
-		return fmt.Errorf("stat tarball: %w", err)
+		return nil, err
 	}
+	return &verifyingBlobReader{f: f, digest: l.desc.Digest, hasher: sha256.New()}, nil
+}
+
+// verifyingBlobReader hashes a cached blob as it is read. Close reads whatever the caller
+// left unread, and deletes the blob and returns errCorruptCacheBlob on a digest mismatch.
+type verifyingBlobReader struct {
+	f      *os.File
+	digest v1.Hash
+	hasher hash.Hash
+}
+
+func (r *verifyingBlobReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.hasher.Write(p[:n])
+	return n, err
+}
 
-	// Write metadata
-	entry := cacheEntry{
-		ImageRef:  imageRef,
-		Digest:    digest.String(),
-		CachedAt:  time.Now(),
-		SizeBytes: info.Size(),
+func (r *verifyingBlobReader) Close() error {
+	_, drainErr := io.Copy(r.hasher, r.f)
+	if err := r.f.Close(); err != nil {
+		return err
 	}
-	metaData, err := json.MarshalIndent(entry, "", "  ")
-	if err != nil {
-		return fmt.Errorf("marshal metadata: %w", err)
+	if drainErr != nil || r.digest.Algorithm != "sha256" {
+		return drainErr
 	}
-	if err := os.WriteFile(metaPath, metaData, 0644); err != nil {
-		return fmt.Errorf("write metadata: %w", err)
+	if hex.EncodeToString(r.hasher.Sum(nil)) != r.digest.Hex {
+		_ = os.Remove(cacheBlobPath(r.digest))
+		return fmt.Errorf("%w %s", errCorruptCacheBlob, r.digest)
 	}
-
 	return nil
 }
 
-func listCache() ([]cacheEntry, error) {
+// readVerifiedCacheBlob reads a small blob (manifest or config) and checks its digest,
+// deleting it when corrupt so the next save writes it again
+func readVerifiedCacheBlob(h v1.Hash) ([]byte, error) {
+	data, err := os.ReadFile(cacheBlobPath(h))
+	if err != nil {
+		return nil, err
+	}
+	if h.Algorithm == "sha256" {
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != h.Hex {
+			_ = os.Remove(cacheBlobPath(h))
+			return nil, fmt.Errorf("%w %s", errCorruptCacheBlob, h)
+		}
+	}
+	return data, nil
+}
+
+// initCacheStore makes the cache directory a valid OCI layout on first use. Caches written
+// before the blob store kept one <ref>.tar and <ref>.json per image at the top level; those
+// files are deleted, and their images are pulled into the store again when next analyzed.
+func initCacheStore() error {
 	cacheDir := getCacheDir()
 	if cacheDir == "" {
-		return nil, fmt.Errorf("could not determine cache directory")
+		return fmt.Errorf("could not determine cache directory")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "oci-layout")); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
+	}
+	if entries, err := os.ReadDir(cacheDir); err == nil {
+		for _, e := range entries {
+			ext := filepath.Ext(e.Name())
+			if e.Type().IsRegular() && (ext == ".tar" || ext == ".json") && e.Name() != "index.json" {
+				_ = os.Remove(filepath.Join(cacheDir, e.Name()))
+			}
+		}
+	}
+	if _, err := layout.Write(cacheDir, empty.Index); err != nil {
+		return fmt.Errorf("init cache layout: %w", err)
 	}
+	return nil
+}
 
-	entries, err := os.ReadDir(cacheDir)
-	if os.IsNotExist(err) {
-		return nil, nil
+// writeCacheIndex rebuilds index.json from refs/, so the cache stays an OCI layout that
+// other tools can read by ref name. Rebuilds are serialized by a lock and each one reads
+// every ref, so the last one always covers refs written while an earlier one ran.
+func writeCacheIndex() error {
+	if _, err := os.Stat(filepath.Join(getCacheDir(), "oci-layout")); err != nil {
+		return nil // nothing saved yet
 	}
+	indexPath := filepath.Join(getCacheDir(), "index.json")
+	unlock, err := lockCacheRef(context.Background(), indexPath, "", func() {})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("lock cache index: %w", err)
 	}
+	defer unlock()
 
-	var cached []cacheEntry
+	entries, err := listCache()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return imageLabel(entries[i].ImageRef, entries[i].Platform) < imageLabel(entries[j].ImageRef, entries[j].Platform)
+	})
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex, Manifests: []v1.Descriptor{}}
 	for _, e := range entries {
-		if !strings.HasSuffix(e.Name(), ".json") {
-			continue
-		}
-		data, err := os.ReadFile(filepath.Join(cacheDir, e.Name()))
+		desc, err := cacheIndexDescriptor(e)
 		if err != nil {
 			continue
 		}
-		var entry cacheEntry
-		if err := json.Unmarshal(data, &entry); err != nil {
-			continue
-		}
-		cached = append(cached, entry)
+		index.Manifests = append(index.Manifests, desc)
 	}
-	return cached, nil
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(indexPath, data)
 }
 
-func clearCache() error {
-	cacheDir := getCacheDir()
-	if cacheDir == "" {
-		return fmt.Errorf("could not determine cache directory")
+// cacheIndexDescriptor describes a cached image in an OCI index, named by its ref
+func cacheIndexDescriptor(e cacheEntry) (v1.Descriptor, error) {
+	h, err := v1.NewHash(e.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
 	}
-	return os.RemoveAll(cacheDir)
+	raw, err := os.ReadFile(cacheBlobPath(h))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{
+		MediaType:   manifest.MediaType,
+		Size:        int64(len(raw)),
+		Digest:      h,
+		Annotations: map[string]string{ociRefNameAnnotation: e.ImageRef},
+	}
+	if desc.MediaType == "" {
+		desc.MediaType = types.OCIManifestSchema1
+	}
+	if e.Platform != "" {
+		desc.Platform, _ = v1.ParsePlatform(e.Platform)
+	}
+	return desc, nil
 }
 
-func removeCacheEntry(imageRef string) error {
-	tarPath, metaPath := getCachePaths(imageRef)
-	if tarPath == "" {
-		return fmt.Errorf("could not determine cache path")
-	}
-	_ = os.Remove(tarPath)
-	_ = os.Remove(metaPath)
-	return nil
+// cacheBlobExists reports whether a complete blob is already stored
+func cacheBlobExists(h v1.Hash, size int64) bool {
+	info, err := os.Stat(cacheBlobPath(h))
+	return err == nil && info.Mode().IsRegular() && info.Size() == size
 }
 
-func handleCacheCommand(args []string) {
-	if len(args) == 0 {
-		fmt.Println("Usage: pkgpulse cache <command>")
-		fmt.Println("\nCommands:")
-		fmt.Println("  list    List cached images")
-		fmt.Println("  clear   Remove all cached images")
-		fmt.Println("  rm      Remove specific cached image")
-		fmt.Println("  path    Show cache directory path")
-		os.Exit(1)
+// writeCacheBlob stores a blob unless it is already present. The data goes to a temp file
+// and is renamed into place once its digest checks out, so readers never see a partial blob.
+func writeCacheBlob(h v1.Hash, size int64, open func() (io.ReadCloser, error)) (err error) {
+	if cacheBlobExists(h, size) {
+		return nil
+	}
+	blobPath := cacheBlobPath(h)
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	rc, err := open()
+	if err != nil {
+		return err
 	}
+	defer rc.Close()
 
-	switch args[0] {
-	case "list":
-		entries, err := listCache()
+	tmp, err := os.CreateTemp(filepath.Dir(blobPath), h.Hex+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
 		if err != nil {
-			log.Fatalf("list cache: %v", err)
-		}
-		if len(entries) == 0 {
-			fmt.Println("Cache is empty")
-			return
-		}
-		fmt.Printf("%-50s %10s %s\n", "IMAGE", "SIZE", "CACHED AT")
-		fmt.Println(strings.Repeat("-", 80))
-		var totalSize int64
-		for _, e := range entries {
-			sizeMB := float64(e.SizeBytes) / (1024 * 1024)
-			fmt.Printf("%-50s %8.1f MB %s\n", trunc(e.ImageRef, 50), sizeMB, e.CachedAt.Format("2006-01-02 15:04"))
-			totalSize += e.SizeBytes
+			_ = os.Remove(tmp.Name())
 		}
-		fmt.Println(strings.Repeat("-", 80))
-		fmt.Printf("Total: %d images, %.1f MB\n", len(entries), float64(totalSize)/(1024*1024))
+	}()
 
-	case "clear":
-		if err := clearCache(); err != nil {
-			log.Fatalf("clear cache: %v", err)
-		}
-		fmt.Println("Cache cleared")
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hasher), rc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("blob %s: expected %d bytes, got %d", h, size, n)
+	}
+	if h.Algorithm == "sha256" && hex.EncodeToString(hasher.Sum(nil)) != h.Hex {
+		return fmt.Errorf("blob %s: digest mismatch", h)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), blobPath)
+}
+
+// saveToCache stores img and points imageRef at it. tagDigest is the digest the ref
+// resolved to in the registry, used later to detect a moved tag.
+// Cancelling ctx stops the save between blobs; the blob being written is removed and the
+// ref is left untouched.
+func saveToCache(ctx context.Context, imageRef, platform, tagDigest string, img v1.Image, logProgress func(string)) error {
+	refPath := getCacheRefPath(imageRef, platform)
+	if refPath == "" {
+		return fmt.Errorf("could not determine cache directory")
+	}
+	if err := initCacheStore(); err != nil {
+		return err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return fmt.Errorf("get digest: %w", err)
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+
+	// Concurrent saves of the same ref (other processes, or two arguments resolving to the
+	// same image) queue here; the second finds every blob present and downloads nothing
+	unlock, err := lockCacheRef(ctx, refPath, digest.String(), func() {
+		logProgress("Waiting for another pkgpulse process writing this image...")
+	})
+	if err != nil {
+		return fmt.Errorf("lock cache entry: %w", err)
+	}
+	defer unlock()
+	markCacheDigestInUse(digest)
+
+	// Layers already in the store (shared base layers, re-tagged images) are not downloaded again
+	var missing []v1.Descriptor
+	for _, desc := range manifest.Layers {
+		if !cacheBlobExists(desc.Digest, desc.Size) {
+			missing = append(missing, desc)
+		}
+	}
+	logProgress(fmt.Sprintf("Saving to cache (%d of %d layers already cached)...", len(manifest.Layers)-len(missing), len(manifest.Layers)))
+
+	// The manifest goes first: with the lock naming it, pruning keeps every blob it lists
+	if err := writeCacheBlob(digest, int64(len(rawManifest)), func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(rawManifest)), nil
+	}); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	for _, desc := range missing {
+		if err := ctx.Err(); err != nil {
+			return context.Cause(ctx)
+		}
+		layer, err := img.LayerByDigest(desc.Digest)
+		if err != nil {
+			return fmt.Errorf("get layer %s: %w", desc.Digest, err)
+		}
+		open := func() (io.ReadCloser, error) {
+			rc, err := layer.Compressed()
+			if err != nil {
+				return nil, err
+			}
+			return contextReadCloser{ctx, rc}, nil
+		}
+		if err := writeCacheBlob(desc.Digest, desc.Size, open); err != nil {
+			return fmt.Errorf("write layer: %w", err)
+		}
+	}
+
+	if err := writeCacheBlob(manifest.Config.Digest, manifest.Config.Size, func() (io.ReadCloser, error) {
+		rawConfig, err := img.RawConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(rawConfig)), nil
+	}); err != nil {
+		return fmt.Errorf("write config: %w", err)
+	}
+
+	// Write the ref pointer last so it only ever names a complete image
+	now := time.Now()
+	if err := writeCacheEntry(refPath, cacheEntry{
+		ImageRef:    imageRef,
+		Platform:    platform,
+		Digest:      digest.String(),
+		TagDigest:   tagDigest,
+		CachedAt:    now,
+		ValidatedAt: now,
+		LastUsedAt:  now,
+		SizeBytes:   manifestCompressedSize(manifest) + int64(len(rawManifest)),
+	}); err != nil {
+		return err
+	}
+	if err := writeCacheIndex(); err != nil {
+		return fmt.Errorf("update cache index: %w", err)
+	}
+
+	// The limit is best effort: a bad setting or failed eviction doesn't fail the save
+	if err := enforceCacheLimit(logProgress); err != nil {
+		logProgress(fmt.Sprintf("Cache limit not enforced: %v", err))
+	}
+	return nil
+}
+
+func writeCacheEntry(refPath string, entry cacheEntry) error {
+	metaData, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal metadata: %w", err)
+	}
+	if err := writeFileAtomic(refPath, metaData); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path via a temp file and rename, so concurrent readers see
+// either the old or the new content, never a partial write
+func writeFileAtomic(path string, data []byte) (err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func getCacheLockPath(refPath string) string {
+	return filepath.Join(getCacheDir(), "locks", strings.TrimSuffix(filepath.Base(refPath), ".json")+".lock")
+}
+
+// lockCacheRef takes a per-ref lock shared by every pkgpulse process using the cache. It is
+// a lock file created with O_EXCL, which works on every platform without flock. The file
+// names the manifest being written so pruning keeps its blobs before the ref points at
+// them, and its mtime is refreshed until unlock so a crashed holder's lock goes stale.
+func lockCacheRef(ctx context.Context, refPath, digest string, onWait func()) (unlock func(), err error) {
+	waiting := false
+	for {
+		unlock, ok, err := tryLockCacheRef(refPath, digest)
+		if err != nil || ok {
+			return unlock, err
+		}
+		if !waiting {
+			onWait()
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		case <-time.After(cacheLockPoll):
+		}
+	}
+}
+
+// tryLockCacheRef takes the lock of lockCacheRef if no live process holds it
+func tryLockCacheRef(refPath, digest string) (unlock func(), ok bool, err error) {
+	lockPath := getCacheLockPath(refPath)
+	if err := os.MkdirAll(filepath.Dir(lockPath), 0755); err != nil {
+		return nil, false, err
+	}
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, werr := f.WriteString(digest)
+			if cerr := f.Close(); werr == nil {
+				werr = cerr
+			}
+			if werr != nil {
+				_ = os.Remove(lockPath)
+				return nil, false, werr
+			}
+			break
+		}
+		if !os.IsExist(err) {
+			return nil, false, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > cacheLockStale {
+			_ = os.Remove(lockPath)
+			continue
+		}
+		return nil, false, nil
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(cacheLockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				_ = os.Chtimes(lockPath, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+		_ = os.Remove(lockPath)
+	}, true, nil
+}
+
+// touchCacheEntry updates fields of a ref's entry, such as its timestamps, under the
+// ref's lock. The entry is read again there and left alone if it no longer points at
+// digest, so a stale copy never reverts a ref another process just saved. It is best
+// effort: while the ref is locked, it is being written and the update is skipped.
+func touchCacheEntry(refPath, digest string, update func(e *cacheEntry)) error {
+	unlock, ok, err := tryLockCacheRef(refPath, digest)
+	if err != nil || !ok {
+		return err
+	}
+	defer unlock()
+	entry, err := readCacheEntry(refPath)
+	if err != nil || entry.Digest != digest {
+		return nil
+	}
+	update(&entry)
+	return writeCacheEntry(refPath, entry)
+}
+
+// removeCacheRef deletes a ref pointer under its lock, waiting for a save in progress
+func removeCacheRef(refPath string) error {
+	entry, _ := readCacheEntry(refPath)
+	unlock, err := lockCacheRef(context.Background(), refPath, entry.Digest, func() {})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := os.Remove(refPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lockedCacheDigests returns the manifests that live locks are currently writing
+func lockedCacheDigests() []string {
+	entries, err := os.ReadDir(filepath.Join(getCacheDir(), "locks"))
+	if err != nil {
+		return nil
+	}
+	var digests []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !strings.HasSuffix(e.Name(), ".lock") || time.Since(info.ModTime()) > cacheLockStale {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(getCacheDir(), "locks", e.Name()))
+		if err == nil {
+			digests = append(digests, string(data))
+		}
+	}
+	return digests
+}
+
+func analysisCachePath(digest string) string {
+	h, err := v1.NewHash(digest)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(getCacheDir(), "analysis", h.Algorithm, h.Hex+".json")
+}
+
+// loadAnalysisFromCache returns the packages found by an earlier native analysis of the
+// image with this manifest digest, if it was made by the current parser version and
+// covered at least the requested languages. Packages of other languages are left out.
+func loadAnalysisFromCache(digest string, languages []string) ([]pkg, bool) {
+	path := analysisCachePath(digest)
+	if path == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var entry analysisCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false
+	}
+	if entry.ParserVersion != parserVersion || entry.Digest != digest {
+		return nil, false
+	}
+	for _, lang := range languages {
+		if !slices.Contains(entry.Languages, lang) {
+			return nil, false
+		}
+	}
+	packages := slices.DeleteFunc(entry.Packages, func(p pkg) bool {
+		return slices.Contains(entry.Languages, p.Type) && !slices.Contains(languages, p.Type)
+	})
+	return packages, true
+}
+
+func saveAnalysisToCache(digest string, languages []string, packages []pkg) error {
+	path := analysisCachePath(digest)
+	if path == "" {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	data, err := json.Marshal(analysisCacheEntry{ParserVersion: parserVersion, Digest: digest, Languages: languages, Packages: packages})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// revalidateCacheEntry reports whether a cache hit still matches the registry. Digest
+// references never move, and tags validated within ttl are trusted; otherwise a manifest
+// HEAD is compared with the digest the tag had when cached. Offline, unvalidated entries
+// are not fresh. moved means the tag now points elsewhere and the image must be re-fetched.
+func revalidateCacheEntry(ref name.Reference, entry *cacheEntry, ttl time.Duration, offline bool, opts []remote.Option) (fresh, moved bool, err error) {
+	if _, ok := ref.(name.Digest); ok {
+		return true, false, nil
+	}
+	if ttl > 0 && time.Since(entry.ValidatedAt) < ttl {
+		return true, false, nil
+	}
+	if offline {
+		return false, false, nil
+	}
+
+	desc, err := remote.Head(ref, opts...)
+	if err != nil {
+		return false, false, err
+	}
+	tagDigest := entry.TagDigest
+	if tagDigest == "" {
+		tagDigest = entry.Digest
+	}
+	if desc.Digest.String() != tagDigest {
+		return false, true, nil
+	}
+
+	entry.ValidatedAt = time.Now()
+	err = touchCacheEntry(getCacheRefPath(entry.ImageRef, entry.Platform), entry.Digest, func(e *cacheEntry) {
+		e.ValidatedAt = entry.ValidatedAt
+	})
+	if err != nil {
+		return true, false, err
+	}
+	return true, false, nil
+}
+
+func listCache() ([]cacheEntry, error) {
+	cacheDir := getCacheDir()
+	if cacheDir == "" {
+		return nil, fmt.Errorf("could not determine cache directory")
+	}
+
+	refsDir := filepath.Join(cacheDir, "refs")
+	entries, err := os.ReadDir(refsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cached []cacheEntry
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		entry, err := readCacheEntry(filepath.Join(refsDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		cached = append(cached, entry)
+	}
+	return cached, nil
+}
+
+// cacheDiskUsage is the size of everything in the cache directory: the blob store, counting
+// each shared blob once, plus refs, analysis results and the layout's index
+func cacheDiskUsage() (int64, error) {
+	var total int64
+	err := filepath.WalkDir(getCacheDir(), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// cacheLease records the manifests of images this process has loaded or is writing, and
+// blobs it is importing, in a file under inuse/. Pruning by any process keeps those blobs
+// and, for manifests, the image's other blobs, so a size limit enforced by one CI job
+// can't remove layers another job is still reading. Like a lock, the file's mtime is
+// refreshed until released, so a crashed process's lease goes stale.
+var cacheLease struct {
+	sync.Mutex
+	path    string
+	digests []string
+	stop    chan struct{}
+}
+
+func markCacheDigestInUse(digest v1.Hash) {
+	cacheLease.Lock()
+	defer cacheLease.Unlock()
+	if slices.Contains(cacheLease.digests, digest.String()) {
+		return
+	}
+	if cacheLease.path == "" {
+		dir := filepath.Join(getCacheDir(), "inuse")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return
+		}
+		cacheLease.path = filepath.Join(dir, fmt.Sprintf("%d-%d.lease", os.Getpid(), time.Now().UnixNano()))
+		stop := make(chan struct{})
+		cacheLease.stop = stop
+		go func(path string) {
+			ticker := time.NewTicker(cacheLockHeartbeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stop:
+					return
+				case now := <-ticker.C:
+					_ = os.Chtimes(path, now, now)
+				}
+			}
+		}(cacheLease.path)
+	}
+	cacheLease.digests = append(cacheLease.digests, digest.String())
+	_ = writeFileAtomic(cacheLease.path, []byte(strings.Join(cacheLease.digests, "\n")))
+}
+
+// releaseCacheLease drops this process's lease once it no longer reads cached images
+func releaseCacheLease() {
+	cacheLease.Lock()
+	defer cacheLease.Unlock()
+	if cacheLease.path == "" {
+		return
+	}
+	close(cacheLease.stop)
+	_ = os.Remove(cacheLease.path)
+	cacheLease.path, cacheLease.digests = "", nil
+}
+
+// inUseCacheDigests returns the digests held by live leases of every process, deleting
+// the leases of processes that died
+func inUseCacheDigests() []string {
+	dir := filepath.Join(getCacheDir(), "inuse")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var digests []string
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || !strings.HasSuffix(e.Name(), ".lease") {
+			continue
+		}
+		if time.Since(info.ModTime()) > cacheLockStale {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, e.Name())); err == nil {
+			digests = append(digests, strings.Fields(string(data))...)
+		}
+	}
+	return digests
+}
+
+// cacheEntryBlobs returns the path and size of every blob a cached image references
+func cacheEntryBlobs(e cacheEntry) (map[string]int64, error) {
+	h, err := v1.NewHash(e.Digest)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(cacheBlobPath(h))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	blobs := map[string]int64{
+		cacheBlobPath(h):                      int64(len(raw)),
+		cacheBlobPath(manifest.Config.Digest): manifest.Config.Size,
+	}
+	for _, l := range manifest.Layers {
+		blobs[cacheBlobPath(l.Digest)] = l.Size
+	}
+	return blobs, nil
+}
+
+// modifiedSince reports whether d was written at or after t
+func modifiedSince(d fs.DirEntry, t time.Time) bool {
+	info, err := d.Info()
+	return err == nil && !info.ModTime().Before(t)
+}
+
+// isLiveTempFile reports whether d is a temp file some process may still be writing.
+// Writers touch the file as they go, so one untouched for cacheLockStale was abandoned.
+func isLiveTempFile(d fs.DirEntry) bool {
+	if !strings.Contains(d.Name(), ".tmp-") {
+		return false
+	}
+	info, err := d.Info()
+	return err == nil && time.Since(info.ModTime()) < cacheLockStale
+}
+
+// pruneCacheBlobs deletes blobs and analysis results no longer referenced by any cached image.
+// Temp files still being written, blobs of images in use by any process and files written
+// since the prune started (whose writer leased them after the leases were read) are left alone.
+func pruneCacheBlobs() error {
+	start := time.Now()
+	entries, err := listCache()
+	if err != nil {
+		return err
+	}
+	// Images being saved right now have blobs but no ref pointer yet, and images being
+	// read may have lost theirs to a prune
+	for _, d := range append(lockedCacheDigests(), inUseCacheDigests()...) {
+		entries = append(entries, cacheEntry{Digest: d})
+	}
+	keep := make(map[string]bool)
+	for _, e := range entries {
+		keep[analysisCachePath(e.Digest)] = true
+		if h, err := v1.NewHash(e.Digest); err == nil {
+			keep[cacheBlobPath(h)] = true // leased blobs being imported need no manifest
+		}
+		blobs, err := cacheEntryBlobs(e)
+		if err != nil {
+			continue
+		}
+		for p := range blobs {
+			keep[p] = true
+		}
+	}
+
+	// Analysis results go with their image
+	err = filepath.WalkDir(filepath.Join(getCacheDir(), "analysis"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() && !keep[p] && !isLiveTempFile(d) && !modifiedSince(d, start) {
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(filepath.Join(getCacheDir(), "blobs"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() && !keep[p] && !isLiveTempFile(d) && !modifiedSince(d, start) {
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// validated is when the registry last confirmed the entry's digest
+func (e cacheEntry) validated() time.Time {
+	if e.ValidatedAt.IsZero() {
+		return e.CachedAt
+	}
+	return e.ValidatedAt
+}
+
+func (e cacheEntry) lastUsed() time.Time {
+	if e.LastUsedAt.IsZero() {
+		return e.CachedAt
+	}
+	return e.LastUsedAt
+}
+
+// pruneCache removes cached images unused for longer than olderThan, then evicts the
+// least recently used images until the blob store fits in maxSize bytes. Zero disables
+// either rule. Images in use by any process are never removed.
+func pruneCache(olderThan time.Duration, maxSize int64) (removed []cacheEntry, err error) {
+	entries, err := listCache()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].lastUsed().Before(entries[j].lastUsed()) })
+
+	// Track how many images share each blob so evicting one only frees what it alone uses
+	entryBlobs := make([]map[string]int64, len(entries))
+	refCount := make(map[string]int)
+	var usage int64
+	for i, e := range entries {
+		blobs, err := cacheEntryBlobs(e)
+		if err != nil {
+			continue
+		}
+		entryBlobs[i] = blobs
+		for p, size := range blobs {
+			if refCount[p] == 0 {
+				usage += size
+			}
+			refCount[p]++
+		}
+	}
+
+	inUse := inUseCacheDigests()
+	for i, e := range entries {
+		expired := olderThan > 0 && time.Since(e.lastUsed()) > olderThan
+		overLimit := maxSize > 0 && usage > maxSize
+		if !expired && !overLimit || slices.Contains(inUse, e.Digest) {
+			continue
+		}
+		if ok, err := removeIdleCacheRef(e); err != nil {
+			return removed, err
+		} else if !ok {
+			continue
+		}
+		removed = append(removed, e)
+		for p, size := range entryBlobs[i] {
+			refCount[p]--
+			if refCount[p] == 0 {
+				usage -= size
+			}
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if err := writeCacheIndex(); err != nil {
+		return removed, fmt.Errorf("update cache index: %w", err)
+	}
+	return removed, pruneCacheBlobs()
+}
+
+// removeIdleCacheRef deletes the ref of a pruned image unless another process is writing
+// it, or has pointed it elsewhere or used it since e was read
+func removeIdleCacheRef(e cacheEntry) (bool, error) {
+	refPath := getCacheRefPath(e.ImageRef, e.Platform)
+	unlock, ok, err := tryLockCacheRef(refPath, e.Digest)
+	if err != nil || !ok {
+		return false, err
+	}
+	defer unlock()
+	current, err := readCacheEntry(refPath)
+	if err != nil || current.Digest != e.Digest || current.lastUsed().After(e.lastUsed()) {
+		return false, nil
+	}
+	if err := os.Remove(refPath); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// enforceCacheLimit applies the size limit from PKGPULSE_CACHE_MAX_SIZE, if set
+func enforceCacheLimit(logProgress func(string)) error {
+	limitStr := os.Getenv(cacheMaxSizeEnv)
+	if limitStr == "" {
+		return nil
+	}
+	limit, err := parseByteSize(limitStr)
+	if err != nil {
+		return fmt.Errorf("%s=%q: %w", cacheMaxSizeEnv, limitStr, err)
+	}
+	removed, err := pruneCache(0, limit)
+	if len(removed) > 0 {
+		logProgress(fmt.Sprintf("Evicted %d least recently used images to stay under %s", len(removed), limitStr))
+	}
+	return err
+}
+
+// parseByteSize accepts sizes like 500MB, 5GB or 1.5T (binary units, as cache list
+// reports) and plain byte counts
+func parseByteSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(str, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		multiplier = 1 << 30
+	case strings.HasSuffix(str, "T"):
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		str = str[:len(str)-1]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || v <= 0 {
+		return 0, errors.New("expected a positive size like 500MB or 5GB")
+	}
+	return int64(v * multiplier), nil
+}
+
+// parseAge is time.ParseDuration plus a "d" (day) unit, e.g. 30d
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n <= 0 {
+			return 0, errors.New("expected a positive age like 30d or 12h")
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, errors.New("expected a positive age like 30d or 12h")
+	}
+	return d, nil
+}
+
+func clearCache() error {
+	cacheDir := getCacheDir()
+	if cacheDir == "" {
+		return fmt.Errorf("could not determine cache directory")
+	}
+	return os.RemoveAll(cacheDir)
+}
+
+// removeCacheEntry removes the default pointer for an image ref and any per-platform
+// pointers, then deletes blobs that no other cached image shares
+func removeCacheEntry(imageRef string) error {
+	refPath := getCacheRefPath(imageRef, "")
+	if refPath == "" {
+		return fmt.Errorf("could not determine cache path")
+	}
+	if err := removeCacheRef(refPath); err != nil {
+		return err
+	}
+
+	entries, err := listCache()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.ImageRef != imageRef || e.Platform == "" {
+			continue
+		}
+		if err := removeCacheRef(getCacheRefPath(e.ImageRef, e.Platform)); err != nil {
+			return err
+		}
+	}
+	if err := writeCacheIndex(); err != nil {
+		return fmt.Errorf("update cache index: %w", err)
+	}
+	return pruneCacheBlobs()
+}
+
+// exportCache writes cached images as a tar bundle for importCache on another machine.
+// The bundle is itself an OCI image layout (index.json names each image by ref), plus
+// the refs/ pointers and analysis/ results that make it a pkgpulse cache.
+func exportCache(w io.Writer, entries []cacheEntry) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	addBytes := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: now, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	addFile := func(name, path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: now, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		return err
+	}
+
+	if err := addBytes("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	// Blobs first, so an importer has every blob before the ref pointers that need them
+	index := v1.IndexManifest{SchemaVersion: 2, MediaType: types.OCIImageIndex}
+	written := make(map[string]bool)
+	for _, e := range entries {
+		blobs, err := cacheEntryBlobs(e)
+		if err != nil {
+			return fmt.Errorf("%s: %w", imageLabel(e.ImageRef, e.Platform), err)
+		}
+		paths := make([]string, 0, len(blobs))
+		for p := range blobs {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			if written[p] {
+				continue
+			}
+			written[p] = true
+			rel, err := filepath.Rel(getCacheDir(), p)
+			if err != nil {
+				return err
+			}
+			if err := addFile(filepath.ToSlash(rel), p); err != nil {
+				return fmt.Errorf("%s: %w", imageLabel(e.ImageRef, e.Platform), err)
+			}
+		}
+
+		desc, err := cacheIndexDescriptor(e)
+		if err != nil {
+			return err
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+
+	for _, e := range entries {
+		if analysisPath := analysisCachePath(e.Digest); !written[analysisPath] {
+			written[analysisPath] = true
+			if _, err := os.Stat(analysisPath); err == nil {
+				rel, err := filepath.Rel(getCacheDir(), analysisPath)
+				if err != nil {
+					return err
+				}
+				if err := addFile(filepath.ToSlash(rel), analysisPath); err != nil {
+					return err
+				}
+			}
+		}
+		data, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := addBytes("refs/"+filepath.Base(getCacheRefPath(e.ImageRef, e.Platform)), data); err != nil {
+			return err
+		}
+	}
+
+	indexData, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addBytes("index.json", indexData); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// importCache adds the images in a bundle written by exportCache to the cache. Blobs are
+// verified against their digests as they are stored, and a ref is only imported when
+// every blob it needs is present (else it is skipped). Imported refs replace existing
+// entries for the same ref, unless the local entry was validated more recently (kept).
+// Imported images count as cached and used now, so pruning treats them as fresh.
+func importCache(r io.Reader) (imported, skipped, kept []cacheEntry, err error) {
+	if err := initCacheStore(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var entries []cacheEntry
+	analyses := make(map[string][]byte) // manifest digest -> analysis result
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("read bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// Paths are rebuilt from validated digests and refs, never taken from the bundle
+		parts := strings.Split(strings.TrimPrefix(hdr.Name, "./"), "/")
+		switch {
+		case len(parts) == 3 && parts[0] == "blobs":
+			h, err := v1.NewHash(parts[1] + ":" + parts[2])
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("bundle entry %s: %w", hdr.Name, err)
+			}
+			// No ref names the blob until its image is imported, so lease it against pruning
+			markCacheDigestInUse(h)
+			if err := writeCacheBlob(h, hdr.Size, func() (io.ReadCloser, error) {
+				return io.NopCloser(tr), nil
+			}); err != nil {
+				return nil, nil, nil, fmt.Errorf("import blob: %w", err)
+			}
+		case len(parts) == 2 && parts[0] == "refs" && strings.HasSuffix(parts[1], ".json"):
+			var entry cacheEntry
+			if err := json.NewDecoder(tr).Decode(&entry); err != nil {
+				return nil, nil, nil, fmt.Errorf("bundle entry %s: %w", hdr.Name, err)
+			}
+			entries = append(entries, entry)
+		case len(parts) == 3 && parts[0] == "analysis" && strings.HasSuffix(parts[2], ".json"):
+			h, err := v1.NewHash(parts[1] + ":" + strings.TrimSuffix(parts[2], ".json"))
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("bundle entry %s: %w", hdr.Name, err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("read bundle: %w", err)
+			}
+			analyses[h.String()] = data
+		}
+	}
+
+	for _, e := range entries {
+		if e.ImageRef == "" {
+			continue
+		}
+		if _, err := loadCachedImage(e.Digest); err != nil {
+			skipped = append(skipped, e)
+			continue
+		}
+		if data, ok := analyses[e.Digest]; ok {
+			if err := writeFileAtomic(analysisCachePath(e.Digest), data); err != nil {
+				return imported, skipped, kept, fmt.Errorf("import analysis: %w", err)
+			}
+		}
+		refPath := getCacheRefPath(e.ImageRef, e.Platform)
+		unlock, err := lockCacheRef(context.Background(), refPath, e.Digest, func() {})
+		if err != nil {
+			return imported, skipped, kept, fmt.Errorf("lock cache entry: %w", err)
+		}
+		if local, err := readCacheEntry(refPath); err == nil && !local.validated().Before(e.validated()) {
+			unlock()
+			kept = append(kept, local)
+			continue
+		}
+		now := time.Now()
+		e.CachedAt, e.LastUsedAt = now, now
+		err = writeCacheEntry(refPath, e)
+		unlock()
+		if err != nil {
+			return imported, skipped, kept, err
+		}
+		imported = append(imported, e)
+	}
+	if len(imported) > 0 {
+		if err := writeCacheIndex(); err != nil {
+			return imported, skipped, kept, fmt.Errorf("update cache index: %w", err)
+		}
+	}
+	return imported, skipped, kept, nil
+}
+
+/* ---- Local image sources ---- */
+
+// parseLocalImageRef recognizes oci:<dir>[:tag], docker-archive:<file>[:ref] and dir:<rootfs> arguments
+func parseLocalImageRef(image string) (localImageRef, bool) {
+	var kind, rest string
+	switch {
+	case strings.HasPrefix(image, rootfsDirPrefix):
+		return localImageRef{Kind: "dir", Path: strings.TrimPrefix(image, rootfsDirPrefix)}, true
+	case strings.HasPrefix(image, ociLayoutPrefix):
+		kind, rest = "oci", strings.TrimPrefix(image, ociLayoutPrefix)
+	case strings.HasPrefix(image, dockerArchivePrefix):
+		kind, rest = "archive", strings.TrimPrefix(image, dockerArchivePrefix)
+	default:
+		return localImageRef{}, false
+	}
+	path, tag := splitLocalPathTag(rest)
+	return localImageRef{Kind: kind, Path: path, Tag: tag}, true
+}
+
+// splitLocalPathTag splits "path[:tag]" at the first colon whose prefix exists on disk,
+// so paths and tags that themselves contain colons (e.g. "img.tar:alpine:3.20") still work.
+func splitLocalPathTag(s string) (path, tag string) {
+	if _, err := os.Stat(s); err == nil {
+		return s, ""
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != ':' {
+			continue
+		}
+		if _, err := os.Stat(s[:i]); err == nil {
+			return s[:i], s[i+1:]
+		}
+	}
+	return s, ""
+}
+
+func loadLocalImage(src localImageRef, platform *v1.Platform) (v1.Image, error) {
+	switch src.Kind {
+	case "oci":
+		return loadOCILayoutImage(src.Path, src.Tag, platform)
+	case "archive":
+		var tag *name.Tag
+		if src.Tag != "" {
+			t, err := name.NewTag(src.Tag)
+			if err != nil {
+				return nil, fmt.Errorf("parse archive tag %q: %w", src.Tag, err)
+			}
+			tag = &t
+		}
+		img, err := tarball.ImageFromPath(src.Path, tag)
+		if err != nil {
+			return nil, fmt.Errorf("read docker archive %s: %w", src.Path, err)
+		}
+		return img, nil
+	default:
+		return nil, fmt.Errorf("unknown local image source: %s", src.Kind)
+	}
+}
+
+// loadOCILayoutImage selects an image from an OCI layout directory by its ref.name
+// annotation. Without a tag the layout must contain exactly one matching manifest.
+func loadOCILayoutImage(path, tag string, platform *v1.Platform) (v1.Image, error) {
+	idx, desc, err := selectOCILayoutManifest(path, tag, platform)
+	if err != nil {
+		return nil, err
+	}
+	return imageFromIndexDescriptor(idx, desc, platform)
+}
+
+func selectOCILayoutManifest(path, tag string, platform *v1.Platform) (v1.ImageIndex, v1.Descriptor, error) {
+	idx, err := layout.ImageIndexFromPath(path)
+	if err != nil {
+		return nil, v1.Descriptor{}, fmt.Errorf("read OCI layout %s: %w", path, err)
+	}
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, v1.Descriptor{}, fmt.Errorf("read OCI layout index: %w", err)
+	}
+
+	var matches []v1.Descriptor
+	for _, desc := range indexManifest.Manifests {
+		refName := desc.Annotations[ociRefNameAnnotation]
+		if tag != "" && refName != tag && !strings.HasSuffix(refName, ":"+tag) {
+			continue
+		}
+		// Top-level manifests that declare a platform must match the requested one
+		if platform != nil && desc.Platform != nil && !desc.Platform.Satisfies(*platform) {
+			continue
+		}
+		matches = append(matches, desc)
+	}
+
+	// A tag can be the suffix of several ref names (registry.example.com/app:1.0 and
+	// app:1.0); one named exactly as requested wins
+	if tag != "" && len(matches) > 1 {
+		var exact []v1.Descriptor
+		for _, desc := range matches {
+			if desc.Annotations[ociRefNameAnnotation] == tag {
+				exact = append(exact, desc)
+			}
+		}
+		if len(exact) > 0 {
+			matches = exact
+		}
+	}
+
+	switch {
+	case len(matches) == 0 && tag != "":
+		return nil, v1.Descriptor{}, fmt.Errorf("no manifest tagged %q in OCI layout %s", tag, path)
+	case len(matches) == 0:
+		return nil, v1.Descriptor{}, fmt.Errorf("OCI layout %s contains no matching manifests", path)
+	case len(matches) > 1 && tag == "":
+		return nil, v1.Descriptor{}, fmt.Errorf("OCI layout %s contains %d manifests, select one with %s%s:<tag>", path, len(matches), ociLayoutPrefix, path)
+	case len(matches) > 1:
+		candidates := make([]string, 0, len(matches))
+		for _, desc := range matches {
+			candidate := desc.Annotations[ociRefNameAnnotation] + " (" + desc.Digest.String()
+			if desc.Platform != nil {
+				candidate += ", " + desc.Platform.String()
+			}
+			candidates = append(candidates, candidate+")")
+		}
+		return nil, v1.Descriptor{}, fmt.Errorf("tag %q matches %d manifests in OCI layout %s, select one by its full ref name or --platform: %s",
+			tag, len(matches), path, strings.Join(candidates, ", "))
+	}
+
+	return idx, matches[0], nil
+}
+
+// imageFromIndexDescriptor resolves a descriptor to an image, descending into nested
+// indexes. Without a requested platform it prefers linux/amd64 like remote.Image does.
+func imageFromIndexDescriptor(idx v1.ImageIndex, desc v1.Descriptor, platform *v1.Platform) (v1.Image, error) {
+	if desc.MediaType.IsImage() {
+		return idx.Image(desc.Digest)
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, fmt.Errorf("unsupported manifest media type: %s", desc.MediaType)
+	}
+
+	child, err := idx.ImageIndex(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("read nested index: %w", err)
+	}
+	childManifest, err := child.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("read nested index manifest: %w", err)
+	}
+
+	want := v1.Platform{OS: "linux", Architecture: "amd64"}
+	if platform != nil {
+		want = *platform
+	}
+	var fallback *v1.Descriptor
+	for i, d := range childManifest.Manifests {
+		if !d.MediaType.IsImage() {
+			continue
+		}
+		if d.Platform != nil && d.Platform.Satisfies(want) {
+			return child.Image(d.Digest)
+		}
+		if fallback == nil {
+			fallback = &childManifest.Manifests[i]
+		}
+	}
+	if platform != nil {
+		return nil, fmt.Errorf("nested index %s has no image for platform %s", desc.Digest, platform)
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("nested index %s contains no images", desc.Digest)
+	}
+	return child.Image(fallback.Digest)
+}
+
+/* ---- Platforms ---- */
+
+// imageLabel formats an image ref with its platform, if one was selected
+func imageLabel(image, platform string) string {
+	if platform == "" {
+		return image
+	}
+	return fmt.Sprintf("%s (%s)", image, platform)
+}
+
+// expandImagePlatforms turns each multi-platform image into one job per platform.
+// Single-platform images and local sources without an index become a single job.
+func expandImagePlatforms(ctx context.Context, images []string, opts runOptions) []imageJob {
+	expanded := make([][]imageJob, len(images))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, opts.concurrency)
+
+	for i, image := range images {
+		wg.Add(1)
+		go func(idx int, image string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			// On error keep the image unexpanded; analysis reports the failure for it
+			ctx := ctx
+			if opts.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+				defer cancel()
+			}
+			var platforms []v1.Platform
+			var err error
+			if opts.offline {
+				platforms, err = listCachedPlatforms(ctx, image)
+			} else {
+				platforms, err = listImagePlatforms(ctx, image)
+			}
+			if err != nil || len(platforms) == 0 {
+				expanded[idx] = []imageJob{{Image: image}}
+				return
+			}
+			for _, p := range platforms {
+				expanded[idx] = append(expanded[idx], imageJob{Image: image, Platform: &p})
+			}
+		}(i, image)
+	}
+	wg.Wait()
+
+	var jobs []imageJob
+	for _, group := range expanded {
+		jobs = append(jobs, group...)
+	}
+	return jobs
+}
+
+// listImagePlatforms returns the platforms of an image index, or nil for single-platform images
+func listImagePlatforms(ctx context.Context, image string) ([]v1.Platform, error) {
+	if src, ok := parseLocalImageRef(image); ok {
+		if src.Kind != "oci" {
+			return nil, nil
+		}
+		idx, desc, err := selectOCILayoutManifest(src.Path, src.Tag, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !desc.MediaType.IsIndex() {
+			return nil, nil
+		}
+		child, err := idx.ImageIndex(desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("read nested index: %w", err)
+		}
+		return indexPlatforms(child)
+	}
+
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain), remote.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", image, err)
+	}
+	if !desc.MediaType.IsIndex() {
+		return nil, nil
+	}
+	idx, err := desc.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("read index %s: %w", image, err)
+	}
+	return indexPlatforms(idx)
+}
+
+// listCachedPlatforms returns the platforms cached for a registry image, for --offline runs
+func listCachedPlatforms(ctx context.Context, image string) ([]v1.Platform, error) {
+	if _, ok := parseLocalImageRef(image); ok {
+		return listImagePlatforms(ctx, image)
+	}
+	entries, err := listCache()
+	if err != nil {
+		return nil, err
+	}
+	var platforms []v1.Platform
+	for _, e := range entries {
+		if e.ImageRef != image || e.Platform == "" {
+			continue
+		}
+		p, err := v1.ParsePlatform(e.Platform)
+		if err != nil {
+			continue
+		}
+		platforms = append(platforms, *p)
+	}
+	sort.Slice(platforms, func(i, j int) bool { return platforms[i].String() < platforms[j].String() })
+	return platforms, nil
+}
+
+func indexPlatforms(idx v1.ImageIndex) ([]v1.Platform, error) {
+	indexManifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("read index manifest: %w", err)
+	}
+	var platforms []v1.Platform
+	for _, d := range indexManifest.Manifests {
+		// Skip nested indexes and attestation manifests (platform unknown/unknown)
+		if !d.MediaType.IsImage() || d.Platform == nil || d.Platform.OS == "unknown" {
+			continue
+		}
+		platforms = append(platforms, *d.Platform)
+	}
+	return platforms, nil
+}
+
+// syftSourceArg maps pkgpulse image arguments to syft source schemes
+func syftSourceArg(image string) string {
+	src, ok := parseLocalImageRef(image)
+	if !ok {
+		return image
+	}
+	switch src.Kind {
+	case "oci":
+		return "oci-dir:" + src.Path
+	case "dir":
+		return "dir:" + src.Path
+	default:
+		return "docker-archive:" + src.Path
+	}
+}
+
+func handleCacheCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: pkgpulse cache <command>")
+		fmt.Println("\nCommands:")
+		fmt.Println("  list    List cached images")
+		fmt.Println("  clear   Remove all cached images")
+		fmt.Println("  rm      Remove specific cached image")
+		fmt.Println("  prune   Remove old or least recently used images (--older-than, --max-size)")
+		fmt.Println("  export  Bundle cached images into a tar file (-o bundle.tar [images...])")
+		fmt.Println("  import  Add the images in a bundle to the cache")
+		fmt.Println("  path    Show cache directory path")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := listCache()
+		if err != nil {
+			log.Fatalf("list cache: %v", err)
+		}
+		if len(entries) == 0 {
+			fmt.Println("Cache is empty")
+			return
+		}
+		fmt.Printf("%-50s %10s %-16s %s\n", "IMAGE", "SIZE", "CACHED AT", "LAST USED")
+		fmt.Println(strings.Repeat("-", 97))
+		var totalSize int64
+		for _, e := range entries {
+			sizeMB := float64(e.SizeBytes) / (1024 * 1024)
+			fmt.Printf("%-50s %8.1f MB %-16s %s\n", trunc(imageLabel(e.ImageRef, e.Platform), 50), sizeMB,
+				e.CachedAt.Format("2006-01-02 15:04"), e.lastUsed().Format("2006-01-02 15:04"))
+			totalSize += e.SizeBytes
+		}
+		fmt.Println(strings.Repeat("-", 97))
+		diskSize, err := cacheDiskUsage()
+		if err != nil {
+			log.Fatalf("cache disk usage: %v", err)
+		}
+		fmt.Printf("Total: %d images, %.1f MB on disk (%.1f MB before sharing layers)\n",
+			len(entries), float64(diskSize)/(1024*1024), float64(totalSize)/(1024*1024))
+
+	case "clear":
+		if err := clearCache(); err != nil {
+			log.Fatalf("clear cache: %v", err)
+		}
+		fmt.Println("Cache cleared")
+
+	case "rm":
+		if len(args) < 2 {
+			log.Fatalf("usage: pkgpulse cache rm <image>")
+		}
+		if err := removeCacheEntry(args[1]); err != nil {
+			log.Fatalf("remove cache entry: %v", err)
+		}
+		fmt.Printf("Removed %s from cache\n", args[1])
+
+	case "prune":
+		handleCachePrune(args[1:])
+
+	case "export":
+		handleCacheExport(args[1:])
+
+	case "import":
+		handleCacheImport(args[1:])
+
+	case "path":
+		fmt.Println(getCacheDir())
+
+	default:
+		log.Fatalf("unknown cache command: %s", args[0])
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(1)
+	}
+
+	// Handle --version and --help flags
+	for _, arg := range os.Args[1:] {
+		if arg == "--version" || arg == "-v" {
+			fmt.Printf("pkgpulse version %s\n", version)
+			os.Exit(0)
+		}
+		if arg == "--help" || arg == "-h" {
+			printUsage()
+			os.Exit(0)
+		}
+	}
+
+	// Handle subcommands
+	switch os.Args[1] {
+	case "cache":
+		handleCacheCommand(os.Args[2:])
+		return
+	case "diff":
+		handleDiffCommand(os.Args[2:])
+		return
+	case "snapshot":
+		handleSnapshotCommand(os.Args[2:])
+		return
+	case "check":
+		handleCheckCommand(os.Args[2:])
+		return
+	}
+
+	opts := parseRunFlags(os.Args[1:])
+	if len(opts.images) == 0 {
+		log.Fatalf("no images specified")
+	}
+	if opts.baselinePath != "" || opts.tolerance != "" {
+		log.Fatalf("--baseline and --tolerance are only supported by check")
+	}
+	if opts.failOnChange {
+		log.Fatalf("--fail-on-change is only supported by diff")
+	}
+	if opts.manifestOnly && opts.policyPath != "" {
+		log.Fatalf("--policy needs package data and cannot be combined with --manifest-only")
+	}
+
+	// Load the policy before analysis so a broken file fails fast
+	var pol *policy
+	if opts.policyPath != "" {
+		p, err := loadPolicy(opts.policyPath)
+		if err != nil {
+			log.Fatalf("load policy: %v", err)
+		}
+		pol = p
+	}
+
+	ctx, stop := interruptContext()
+	results := analyzeImages(ctx, buildImageJobs(ctx, opts), opts)
+	stop()
+	failed := countFailed(results)
+
+	var eval *policyEvaluation
+	if pol != nil {
+		eval = &policyEvaluation{Path: opts.policyPath, Results: evaluatePolicy(*pol, results)}
+	}
+
+	out, closeOut := openOutput(opts.outputPath)
+
+	// Notices go to stderr when stdout carries JSON
+	notices := io.Writer(os.Stdout)
+	if opts.format == "json" {
+		notices = os.Stderr
+		if err := writeJSONReport(out, results, eval); err != nil {
+			log.Fatalf("write JSON: %v", err)
+		}
+	} else {
+		writeTextReport(out, results)
+		if eval != nil {
+			displayPolicyReport(out, *eval)
+		}
+	}
+	closeOut()
+	if opts.outputPath != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %s report: %s\n", opts.format, opts.outputPath)
+	}
+
+	csvPath := opts.csvOut
+	autoCSV := false
+	if csvPath == "" && len(results) > 3 && opts.format == "text" {
+		csvPath = "pkgpulse.csv"
+		autoCSV = true
+	}
+
+	if csvPath != "" {
+		if opts.manifestOnly {
+			if err := writeManifestCSV(csvPath, results); err != nil {
+				log.Fatalf("write manifest CSV: %v", err)
+			}
+			fmt.Fprintf(notices, "\nWrote CSV: %s (image,source,compressed_MB,layers,created,architecture)\n", csvPath)
+		} else if len(results) > 1 {
+			if err := writeComparisonCSV(csvPath, results); err != nil {
+				log.Fatalf("write comparison CSV: %v", err)
+			}
+			if autoCSV {
+				fmt.Fprintf(notices, "\nWrote CSV automatically: %s (summary + comparison table)\n", csvPath)
+			} else {
+				fmt.Fprintf(notices, "\nWrote CSV: %s (summary + comparison table)\n", csvPath)
+			}
+		} else {
+			if err := writePackageCSV(csvPath, results[0].Rows); err != nil {
+				log.Fatalf("write CSV: %v", err)
+			}
+			fmt.Fprintf(notices, "\nWrote CSV: %s (package,version,installed_MB)\n", csvPath)
+		}
+	}
+
+	switch {
+	case failed == len(results):
+		os.Exit(exitFailure)
+	case failed > 0:
+		fmt.Fprintf(os.Stderr, "\n%d of %d images failed\n", failed, len(results))
+		os.Exit(exitPartialFailure)
+	}
+	if eval != nil {
+		if violating := eval.violatingImages(); violating > 0 {
+			fmt.Fprintf(os.Stderr, "\n%d of %d images violate policy %s\n", violating, len(eval.Results), eval.Path)
+			os.Exit(exitPolicyViolation)
+		}
+	}
+}
+
+// runOptions holds the flags shared by image analysis and the diff command
+type runOptions struct {
+	images       []string
+	csvOut       string
+	useSyft      bool
+	noCache      bool
+	platform     *v1.Platform
+	allPlatforms bool
+	format       string // "text" or "json"
+	outputPath   string
+	policyPath   string
+	baselinePath string
+	tolerance    string
+	cacheTTL     time.Duration // trust cached tags validated this recently without asking the registry
+	offline      bool          // never contact a registry; only cached and local images can be analyzed
+	manifestOnly bool          // report pull size and config details without downloading layers
+	lazy         bool          // fetch only the needed files of seekable layers with range requests
+	maxMemory    int64         // cap on buffered file contents; 0 keeps defaultMemoryLimit
+	concurrency  int           // images analyzed at once
+	timeout      time.Duration // per-image limit on analysis; 0 means none
+	languages    []string      // language package ecosystems to catalog, sorted
+	failOnChange bool          // diff exits with exitDiffChanged when any package changed
+}
+
+// parseRunFlags parses analysis flags; non-flag arguments are collected as images
+func parseRunFlags(args []string) runOptions {
+	opts := runOptions{format: "text", concurrency: defaultConcurrency}
+	var platformFlag string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "--csv":
+			if i+1 < len(args) {
+				opts.csvOut = args[i+1]
+				i++ // skip next arg
+			}
+		case "--platform":
+			if i+1 < len(args) {
+				platformFlag = args[i+1]
+				i++
+			}
+		case "--all-platforms":
+			opts.allPlatforms = true
+		case "--format":
+			if i+1 < len(args) {
+				opts.format = args[i+1]
+				i++
+			}
+		case "--output", "-o":
+			if i+1 < len(args) {
+				opts.outputPath = args[i+1]
+				i++
+			}
+		case "--policy":
+			if i+1 < len(args) {
+				opts.policyPath = args[i+1]
+				i++
+			}
+		case "--baseline":
+			if i+1 < len(args) {
+				opts.baselinePath = args[i+1]
+				i++
+			}
+		case "--tolerance":
+			if i+1 < len(args) {
+				opts.tolerance = args[i+1]
+				i++
+			}
+		case "--use-syft":
+			opts.useSyft = true
+		case "--no-cache":
+			opts.noCache = true
+		case "--cache-ttl":
+			if i+1 < len(args) {
+				ttl, err := time.ParseDuration(args[i+1])
+				if err != nil || ttl < 0 {
+					log.Fatalf("invalid --cache-ttl %q (expected a duration like 30m or 24h)", args[i+1])
+				}
+				opts.cacheTTL = ttl
+				i++
+			}
+		case "--offline":
+			opts.offline = true
+		case "--manifest-only":
+			opts.manifestOnly = true
+		case "--lazy":
+			opts.lazy = true
+		case "--fail-on-change":
+			opts.failOnChange = true
+		case "--concurrency":
+			if i+1 < len(args) {
+				n, err := strconv.Atoi(args[i+1])
+				if err != nil || n < 1 {
+					log.Fatalf("invalid --concurrency %q (expected a positive number)", args[i+1])
+				}
+				opts.concurrency = n
+				i++
+			}
+		case "--timeout":
+			if i+1 < len(args) {
+				d, err := time.ParseDuration(args[i+1])
+				if err != nil || d <= 0 {
+					log.Fatalf("invalid --timeout %q (expected a duration like 90s or 10m)", args[i+1])
+				}
+				opts.timeout = d
+				i++
+			}
+		case "--max-memory":
+			if i+1 < len(args) {
+				n, err := parseByteSize(args[i+1])
+				if err != nil || n <= 0 {
+					log.Fatalf("invalid --max-memory %q (expected a size like 64MB or 1GB)", args[i+1])
+				}
+				opts.maxMemory = n
+				i++
+			}
+		case "--languages":
+			if i+1 < len(args) {
+				opts.languages = parseLanguages(args[i+1])
+				i++
+			}
+		case "--version", "-v", "--help", "-h":
+			// Already handled in main
+		default:
+			opts.images = append(opts.images, arg)
+		}
+	}
+
+	if opts.format != "text" && opts.format != "json" {
+		log.Fatalf("invalid --format %q (expected text or json)", opts.format)
+	}
+
+	if platformFlag != "" {
+		p, err := v1.ParsePlatform(platformFlag)
+		if err != nil {
+			log.Fatalf("invalid --platform %q: %v", platformFlag, err)
+		}
+		opts.platform = p
+	}
+	if opts.platform != nil && opts.allPlatforms {
+		log.Fatalf("--platform and --all-platforms cannot be combined")
+	}
+	if opts.offline && (opts.noCache || opts.useSyft) {
+		log.Fatalf("--offline cannot be combined with --no-cache or --use-syft")
+	}
+	if opts.manifestOnly && opts.useSyft {
+		log.Fatalf("--manifest-only cannot be combined with --use-syft")
+	}
+	if opts.lazy && (opts.offline || opts.useSyft || opts.manifestOnly) {
+		log.Fatalf("--lazy cannot be combined with --offline, --use-syft or --manifest-only")
+	}
+	if len(opts.languages) > 0 && (opts.useSyft || opts.manifestOnly) {
+		log.Fatalf("--languages cannot be combined with --use-syft or --manifest-only")
+	}
+
+	return opts
+}
+
+// parseLanguages parses a comma-separated --languages list; "all" enables every
+// supported language
+func parseLanguages(value string) []string {
+	var languages []string
+	for _, lang := range strings.Split(value, ",") {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		switch {
+		case lang == "all":
+			languages = append(languages, supportedLanguages...)
+		case slices.Contains(supportedLanguages, lang):
+			languages = append(languages, lang)
+		default:
+			log.Fatalf("invalid --languages %q (expected a list of %s, or all)", value, strings.Join(supportedLanguages, ", "))
+		}
+	}
+	slices.Sort(languages)
+	return slices.Compact(languages)
+}
+
+func buildImageJobs(ctx context.Context, opts runOptions) []imageJob {
+	if opts.allPlatforms {
+		fmt.Fprintf(os.Stderr, "Resolving platforms for %d images...\n", len(opts.images))
+		jobs := expandImagePlatforms(ctx, opts.images, opts)
+		if errors.Is(context.Cause(ctx), errInterrupted) {
+			fmt.Fprintf(os.Stderr, "Interrupted\n")
+			releaseCacheLease() // os.Exit skips deferred calls
+			os.Exit(exitInterrupted)
+		}
+		return jobs
+	}
+	jobs := make([]imageJob, 0, len(opts.images))
+	for _, image := range opts.images {
+		jobs = append(jobs, imageJob{Image: image, Platform: opts.platform})
+	}
+	return jobs
+}
+
+// interruptContext returns a context the first SIGINT/SIGTERM cancels with errInterrupted,
+// so in-flight work stops and cache writes and temp files are cleaned up; a second signal
+// kills the process as usual. It covers resolving platforms as well as analysis.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			signal.Stop(signals)
+			cancel(errInterrupted)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel(nil)
+	}
+}
+
+// analyzeImages analyzes jobs in parallel with live progress and prints a completion
+// summary. It exits with exitInterrupted once ctx is cancelled by interruptContext.
+func analyzeImages(ctx context.Context, jobs []imageJob, opts runOptions) []imageResult {
+	if opts.maxMemory > 0 {
+		fileMemory.setLimit(opts.maxMemory)
+	}
+	defer releaseCacheLease()
+
+	// Analyze images in parallel with bounded concurrency
+	results := make([]imageResult, len(jobs))
+	var wg sync.WaitGroup
+
+	// Semaphore to limit concurrent goroutines
+	sem := make(chan struct{}, opts.concurrency)
+
+	// Channel for single-line progress renderer
+	progressChan := make(chan progressEvent, 256)
+	doneChan := make(chan struct{})
+	go runProgressRenderer(progressChan, len(jobs), doneChan)
+
+	// Build mode description for output
+	modeStr := ""
+	if opts.noCache {
+		modeStr = " (no cache)"
+	}
+	if opts.offline {
+		modeStr = " (offline)"
+	}
+	if opts.useSyft {
+		modeStr += " (using syft)"
+	}
+	if opts.manifestOnly {
+		modeStr += " (manifest only)"
+	}
+	if opts.lazy {
+		modeStr += " (lazy)"
+	}
+	if len(opts.languages) > 0 {
+		modeStr += fmt.Sprintf(" (with %s packages)", strings.Join(opts.languages, ", "))
+	}
+
+	if len(jobs) > 1 {
+		fmt.Fprintf(os.Stderr, "Analyzing %d images in parallel%s...\n", len(jobs), modeStr)
+	} else if modeStr != "" {
+		fmt.Fprintf(os.Stderr, "Analyzing%s...\n", modeStr)
+	}
+
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(idx int, job imageJob) {
+			defer wg.Done()
+			sem <- struct{}{}        // Acquire semaphore
+			defer func() { <-sem }() // Release semaphore
+			send := func(ev progressEvent) {
+				progressChan <- ev
+			}
+			result := analyzeImage(ctx, job.Image, job.Platform, idx, len(jobs), send, opts)
+			results[idx] = result
+		}(i, job)
+	}
+
+	wg.Wait()
+	close(progressChan)
+	<-doneChan
+
+	// Print completion summary
+	for i, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(os.Stderr, "[%d/%d] ✗ %s: %v\n", i+1, len(results), imageLabel(r.Image, r.Platform), r.Err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "[%d/%d] ✓ %s\n", i+1, len(results), imageLabel(r.Image, r.Platform))
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+
+	if errors.Is(context.Cause(ctx), errInterrupted) {
+		fmt.Fprintf(os.Stderr, "Interrupted; incomplete cache writes were removed\n")
+		releaseCacheLease() // os.Exit skips the deferred release
+		os.Exit(exitInterrupted)
+	}
+
+	return results
+}
+
+func countFailed(results []imageResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// openOutput returns the report destination (stdout unless a path is given) and its closer
+func openOutput(path string) (io.Writer, func()) {
+	if path == "" {
+		return os.Stdout, func() {}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("create output file: %v", err)
+	}
+	return f, func() {
+		if err := f.Close(); err != nil {
+			log.Fatalf("write output file: %v", err)
+		}
+	}
+}
+
+func writeTextReport(w io.Writer, results []imageResult) {
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80)))
+
+	if len(results) > 1 {
+		// Multiple images: only show comparison table (skip individual breakdowns)
+		fmt.Fprintln(w, "COMPARISON")
+		fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80))+"\n")
+		if isManifestOnly(results) {
+			displayManifestTable(w, results)
+			return
+		}
+		displayComparisonTable(w, results)
+	} else {
+		// Single image: show detailed breakdown
+		fmt.Fprintln(w, "RESULTS")
+		fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80))+"\n")
+		displayImageBreakdown(w, results[0])
+	}
+}
+
+// handleCacheExport bundles cached images (all of them when none are named) into a tar file
+func handleCacheExport(args []string) {
+	var outputPath string
+	var images []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--output", "-o":
+			if i+1 < len(args) {
+				outputPath = args[i+1]
+				i++
+			}
+		default:
+			images = append(images, args[i])
+		}
+	}
+	if outputPath == "" {
+		log.Fatalf("usage: pkgpulse cache export -o <bundle.tar> [<image>...]")
+	}
+
+	entries, err := listCache()
+	if err != nil {
+		log.Fatalf("list cache: %v", err)
+	}
+	if len(images) > 0 {
+		// Like cache rm, an image selects every cached platform of it
+		var selected []cacheEntry
+		for _, image := range images {
+			found := false
+			for _, e := range entries {
+				if e.ImageRef == image {
+					selected = append(selected, e)
+					found = true
+				}
+			}
+			if !found {
+				log.Fatalf("%s is not cached", image)
+			}
+		}
+		entries = selected
+	}
+	if len(entries) == 0 {
+		log.Fatalf("cache is empty, nothing to export")
+	}
+
+	f, err := os.Create(outputPath)
+	if err != nil {
+		log.Fatalf("create bundle: %v", err)
+	}
+	if err := exportCache(f, entries); err != nil {
+		_ = f.Close()
+		_ = os.Remove(outputPath)
+		log.Fatalf("export cache: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("write bundle: %v", err)
+	}
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		log.Fatalf("stat bundle: %v", err)
+	}
+	for _, e := range entries {
+		fmt.Printf("Exported %s\n", imageLabel(e.ImageRef, e.Platform))
+	}
+	fmt.Printf("Wrote %s (%d images, %.1f MB)\n", outputPath, len(entries), float64(info.Size())/(1024*1024))
+}
+
+func handleCacheImport(args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: pkgpulse cache import <bundle.tar>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		log.Fatalf("open bundle: %v", err)
+	}
+	defer f.Close()
+
+	imported, skipped, kept, err := importCache(f)
+	releaseCacheLease()
+	if err != nil {
+		log.Fatalf("import cache: %v", err)
+	}
+	for _, e := range imported {
+		fmt.Printf("Imported %s\n", imageLabel(e.ImageRef, e.Platform))
+	}
+	for _, e := range skipped {
+		fmt.Fprintf(os.Stderr, "Skipped %s: bundle is missing some of its blobs\n", imageLabel(e.ImageRef, e.Platform))
+	}
+	for _, e := range kept {
+		fmt.Fprintf(os.Stderr, "Kept cached %s: the local entry is at least as recently validated as the bundle's\n", imageLabel(e.ImageRef, e.Platform))
+	}
+	if err := enforceCacheLimit(func(msg string) { fmt.Fprintln(os.Stderr, msg) }); err != nil {
+		fmt.Fprintf(os.Stderr, "Cache limit not enforced: %v\n", err)
+	}
+	fmt.Printf("Imported %d images into %s\n", len(imported), getCacheDir())
+}
+
+// handleCachePrune removes images by age and/or evicts least recently used images down
+// to a size. Without flags it applies the PKGPULSE_CACHE_MAX_SIZE limit.
+func handleCachePrune(args []string) {
+	var olderThan time.Duration
+	var maxSize int64
+	for i := 0; i < len(args); i++ {
+		if i+1 >= len(args) {
+			log.Fatalf("usage: pkgpulse cache prune [--older-than 30d] [--max-size 5GB]")
+		}
+		var err error
+		switch args[i] {
+		case "--older-than":
+			if olderThan, err = parseAge(args[i+1]); err != nil {
+				log.Fatalf("invalid --older-than %q: %v", args[i+1], err)
+			}
+		case "--max-size":
+			if maxSize, err = parseByteSize(args[i+1]); err != nil {
+				log.Fatalf("invalid --max-size %q: %v", args[i+1], err)
+			}
+		default:
+			log.Fatalf("usage: pkgpulse cache prune [--older-than 30d] [--max-size 5GB]")
+		}
+		i++
+	}
+	if olderThan == 0 && maxSize == 0 {
+		limitStr := os.Getenv(cacheMaxSizeEnv)
+		if limitStr == "" {
+			log.Fatalf("usage: pkgpulse cache prune [--older-than 30d] [--max-size 5GB] (or set %s)", cacheMaxSizeEnv)
+		}
+		var err error
+		if maxSize, err = parseByteSize(limitStr); err != nil {
+			log.Fatalf("invalid %s %q: %v", cacheMaxSizeEnv, limitStr, err)
+		}
+	}
+
+	before, err := cacheDiskUsage()
+	if err != nil {
+		log.Fatalf("cache disk usage: %v", err)
+	}
+	removed, err := pruneCache(olderThan, maxSize)
+	if err != nil {
+		log.Fatalf("prune cache: %v", err)
+	}
+	after, err := cacheDiskUsage()
+	if err != nil {
+		log.Fatalf("cache disk usage: %v", err)
+	}
+	for _, e := range removed {
+		fmt.Printf("Removed %s (last used %s)\n", imageLabel(e.ImageRef, e.Platform), e.lastUsed().Format("2006-01-02 15:04"))
+	}
+	fmt.Printf("Pruned %d images, freed %.1f MB (%.1f MB on disk)\n",
+		len(removed), float64(before-after)/(1024*1024), float64(after)/(1024*1024))
+}
+
+func analyzeImage(ctx context.Context, image string, platform *v1.Platform, idx, total int, sendProgress func(progressEvent), opts runOptions) imageResult {
+	useSyft, noCache := opts.useSyft, opts.noCache
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, opts.timeout, fmt.Errorf("timed out after %s", opts.timeout))
+		defer cancel()
+	}
+	platformStr := ""
+	if platform != nil {
+		platformStr = platform.String()
+	}
+	label := imageLabel(image, platformStr)
+
+	emit := func(stage, message string, current, totalSize int64, rateBps float64, done bool) {
+		sendProgress(progressEvent{
+			idx:       idx,
+			total:     total,
+			image:     label,
+			stage:     stage,
+			message:   message,
+			current:   current,
+			totalSize: totalSize,
+			rateBps:   rateBps,
+			done:      done,
+		})
+	}
+
+	// Errors only fail this image; the rest of the comparison continues
+	var source string
+	fail := func(err error) imageResult {
+		// Report why the context ended rather than whichever read noticed it first
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+		}
+		emit("failed", err.Error(), 0, 0, 0, true)
+		return imageResult{
+			Image:      image,
+			Platform:   platformStr,
+			Source:     source,
+			PackageMap: map[packageKey]row{},
+			Err:        err,
+		}
+	}
+
+	if ctx.Err() != nil {
+		return fail(ctx.Err())
+	}
+
+	// Parse image reference
+	emit("resolving", "parsing image reference", 0, 0, 0, false)
+	localSrc, isLocal := parseLocalImageRef(image)
+	var ref name.Reference
+	if !isLocal {
+		var err error
+		ref, err = name.ParseReference(image)
+		if err != nil {
+			return fail(fmt.Errorf("parse image reference: %w", err))
+		}
+	}
+
+	var img v1.Image
+	var digest string
+	var totalCompressed int64
+	var sourceRemote bool
+
+	var downloadedBytes atomic.Int64
+	var estimatedTotalBytes atomic.Int64
+	stopDownloadProgress := make(chan struct{})
+	downloadProgressStopped := make(chan struct{})
+	var stopDownloadOnce sync.Once
+
+	go func() {
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		defer close(downloadProgressStopped)
+		lastBytes := int64(0)
+		lastTick := time.Now()
+		for {
+			select {
+			case <-stopDownloadProgress:
+				return
+			case <-ticker.C:
+				current := downloadedBytes.Load()
+				now := time.Now()
+				delta := current - lastBytes
+				rate := 0.0
+				if dt := now.Sub(lastTick).Seconds(); dt > 0 {
+					rate = float64(delta) / dt
+				}
+				lastBytes = current
+				lastTick = now
+				if current > 0 {
+					emit("downloading", "pulling image bytes", current, estimatedTotalBytes.Load(), rate, false)
+				}
+			}
+		}
+	}()
+	stopDownload := func() {
+		stopDownloadOnce.Do(func() {
+			close(stopDownloadProgress)
+			<-downloadProgressStopped
+		})
+	}
+	defer stopDownload()
+
+	// Local sources are read directly and never cached
+	if isLocal {
+		source = localSrc.Kind
+		if opts.manifestOnly && localSrc.Kind == "dir" {
+			return fail(errors.New("--manifest-only needs an image manifest; root filesystem directories have none"))
+		}
+		if !useSyft && localSrc.Kind != "dir" {
+			emit("local_load", localSrc.Path, 0, 0, 0, false)
+			localImg, err := loadLocalImage(localSrc, platform)
+			if err != nil {
+				return fail(err)
+			}
+			img = localImg
+			if localSrc.Kind == "oci" {
+				// OCI layouts keep compressed blobs, so manifest sizes are real pull sizes
+				manifest, err := img.Manifest()
+				if err != nil {
+					return fail(fmt.Errorf("read manifest: %w", err))
+				}
+				totalCompressed = manifestCompressedSize(manifest)
+				if d, err := img.Digest(); err == nil {
+					digest = d.String()
+				}
+			}
+		}
+	}
+
+	transport := &progressTransport{
+		base: http.DefaultTransport,
+		onBytes: func(n int64) {
+			downloadedBytes.Add(n)
+		},
+	}
+	remoteOpts := []remote.Option{
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+		remote.WithTransport(transport),
+		remote.WithContext(ctx),
+	}
+	if platform != nil {
+		remoteOpts = append(remoteOpts, remote.WithPlatform(*platform))
+	}
+
+	// Try cache first (unless --no-cache or --use-syft)
+	if !isLocal && !noCache && !useSyft {
+		emit("cache_load", "checking local cache", 0, 0, 0, false)
+		if cachedImg, entry, ok := loadFromCache(image, platformStr, func(msg string) {
+			emit("cache_load", msg, 0, 0, 0, false)
+		}); ok {
+			emit("cache_check", "checking tag against registry", 0, 0, 0, false)
+			fresh, moved, err := revalidateCacheEntry(ref, entry, opts.cacheTTL, opts.offline, remoteOpts)
+			if moved {
+				emit("cache_check", "tag moved, refreshing", 0, 0, 0, false)
+			} else {
+				if err != nil {
+					emit("cache_check", fmt.Sprintf("revalidation failed, using cached image: %v", err), 0, 0, 0, false)
+				}
+				img = cachedImg
+				digest = entry.Digest
+				source = sourceCachedStale
+				if fresh {
+					source = sourceCachedFresh
+				}
+				// The store keeps the original compressed layers, so the manifest gives the pull size
+				if manifest, err := img.Manifest(); err == nil {
+					totalCompressed = manifestCompressedSize(manifest)
+				}
+			}
+		}
+	}
+
+	// fetchRemote pulls the image from the registry, saving missing layers to the cache
+	fetchRemote := func() error {
+		if opts.offline {
+			return errors.New("not in cache (--offline)")
+		}
+		sourceRemote = true
+		source = "remote"
+		emit("manifest", "fetching from registry", 0, 0, 0, false)
+		desc, err := remote.Get(ref, remoteOpts...)
+		if err != nil {
+			return err
+		}
+		remoteImg, err := desc.Image()
+		if err != nil {
+			return err
+		}
+		if d, err := remoteImg.Digest(); err == nil {
+			digest = d.String()
+		}
+
+		// Get compressed size from manifest
+		manifest, err := remoteImg.Manifest()
+		if err != nil {
+			return fmt.Errorf("read manifest: %w", err)
+		}
+		totalCompressed = manifestCompressedSize(manifest)
+		estimatedTotalBytes.Store(totalCompressed)
+		emit("downloading", "pulling image bytes", downloadedBytes.Load(), totalCompressed, 0, false)
+
+		img = remoteImg
+		if noCache || useSyft || opts.manifestOnly || opts.lazy {
+			// Manifest-only and lazy runs don't download every layer, so the image can't be cached
+			return nil
+		}
+
+		// Save to cache and reload for consistent fast analysis
+		emit("cache_save", "writing layers to cache", 0, 0, 0, false)
+		if err := saveToCache(ctx, image, platformStr, desc.Digest.String(), remoteImg, func(msg string) {
+			emit("cache_save", msg, 0, 0, 0, false)
+		}); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// Fall back to the remote image if the cache can't be written
+			emit("cache_save", fmt.Sprintf("cache save failed: %v", err), 0, 0, 0, false)
+			return nil
+		}
+		emit("cache_reload", "reloading from cache", 0, 0, 0, false)
+		if cachedImg, _, ok := loadFromCache(image, platformStr, func(msg string) {
+			emit("cache_reload", msg, 0, 0, 0, false)
+		}); ok {
+			img = cachedImg
+			sourceRemote = false
+		}
+		return nil
+	}
+
+	// Fetch from registry if not in cache
+	if img == nil && !isLocal {
+		if err := fetchRemote(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if opts.manifestOnly {
+		emit("config", "reading image config", 0, 0, 0, false)
+		manifest, err := img.Manifest()
+		if err != nil {
+			return fail(fmt.Errorf("read manifest: %w", err))
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return fail(fmt.Errorf("read config: %w", err))
+		}
+		result := imageResult{
+			Image:        image,
+			Platform:     platformStr,
+			Digest:       digest,
+			CompressedMB: toMB(totalCompressed),
+			PackageMap:   map[packageKey]row{},
+			Source:       source,
+			ManifestOnly: true,
+			LayerCount:   len(manifest.Layers),
+			Created:      cfg.Created.Time,
+		}
+		if p := cfg.Platform(); p != nil {
+			result.Architecture = p.String()
+		}
+		emit("done", "completed", 0, 0, 0, true)
+		return result
+	}
+
+	var packages []pkg
+
+	if useSyft {
+		// Fallback to syft
+		stopDownload()
+		emit("syft", "running syft scan", 0, 0, 0, false)
+		var err error
+		packages, err = runSyftAndParse(ctx, syftSourceArg(image), platformStr)
+		if err != nil {
+			return fail(err)
+		}
+	} else if isLocal && localSrc.Kind == "dir" {
+		// Plain rootfs directory: walk the filesystem instead of image layers
+		emit("parsing", "scanning root filesystem", 0, 0, 0, false)
+		var err error
+		packages, err = extractPackagesFromDir(ctx, localSrc.Path, opts.languages, func(message string, current, total int64) {
+			emit("parsing", message, current, total, 0, false)
+		})
+		if err != nil {
+			return fail(err)
+		}
+	} else {
+		// Native parsing, reusing an earlier analysis of the same digest when there is one
+		useAnalysisCache := !isLocal && !noCache && digest != ""
+		cached := false
+		if useAnalysisCache {
+			packages, cached = loadAnalysisFromCache(digest, opts.languages)
+		}
+		if cached {
+			emit("parsing", fmt.Sprintf("using cached analysis (%d packages)", len(packages)), 0, 0, 0, false)
+		} else {
+			emit("parsing", "extracting package databases", 0, 0, 0, false)
+			scanProgress := func(message string, currentLayer, totalLayers int64) {
+				emit("parsing", message, currentLayer, totalLayers, 0, false)
+			}
+			// Cached images are local already; only remote layers are worth reading lazily
+			var lazy *lazyLayerFetcher
+			if opts.lazy && sourceRemote {
+				var err error
+				if lazy, err = newLazyLayerFetcher(ctx, ref, transport); err != nil {
+					emit("parsing", fmt.Sprintf("lazy fetch unavailable, pulling layers: %v", err), 0, 0, 0, false)
+				}
+			}
+			var scanErr error
+			packages, scanErr = extractPackagesFromImage(ctx, img, lazy, opts.languages, scanProgress)
+			if errors.Is(scanErr, errCorruptCacheBlob) {
+				// The bad blob is already deleted; pulling again only downloads what's missing
+				emit("cache_load", fmt.Sprintf("%v, re-fetching", scanErr), 0, 0, 0, false)
+				if err := fetchRemote(); err != nil {
+					return fail(fmt.Errorf("re-fetch after cache corruption: %w", err))
+				}
+				packages, scanErr = extractPackagesFromImage(ctx, img, lazy, opts.languages, scanProgress)
+			}
+			switch {
+			case ctx.Err() != nil:
+				// A cancelled scan is not a partial result worth reporting
+				return fail(ctx.Err())
+			case scanErr != nil:
+				// Keep the partial result for this run, but don't cache it
+				emit("parsing", fmt.Sprintf("incomplete layer scan: %v", scanErr), 0, 0, 0, false)
+			case useAnalysisCache:
+				if err := saveAnalysisToCache(digest, opts.languages, packages); err != nil {
+					emit("parsing", fmt.Sprintf("analysis cache save failed: %v", err), 0, 0, 0, false)
+				}
+			}
+		}
+		if sourceRemote {
+			stopDownload()
+		}
+	}
+
+	emit("processing", fmt.Sprintf("processing %d packages", len(packages)), int64(len(packages)), int64(len(packages)), 0, false)
+
+	// Build output rows
+	rows := make([]row, 0, len(packages))
+	allRows := make([]row, 0, len(packages))
+	pkgMap := make(map[packageKey]row)
+	var totalInstalled int64
+
+	for _, p := range packages {
+		r := row{
+			Name:    p.Name,
+			Ver:     p.Version,
+			Vers:    p.Versions,
+			MB:      float64(p.SizeKB) / 1024.0,
+			Type:    p.Type,
+			SizeKB:  p.SizeKB,
+			Arch:    p.Arch,
+			License: p.License,
+		}
+		allRows = append(allRows, r)
+		if p.SizeKB > 0 {
+			totalInstalled += p.SizeKB
+			rows = append(rows, r)
+			pkgMap[rowKey(r)] = r
+		}
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].MB > rows[j].MB })
+	sort.SliceStable(allRows, func(i, j int) bool { return allRows[i].MB > allRows[j].MB })
+	emit("done", "completed", 0, 0, 0, true)
+
+	return imageResult{
+		Image:        image,
+		Platform:     platformStr,
+		Digest:       digest,
+		CompressedMB: toMB(totalCompressed),
+		InstalledMB:  float64(totalInstalled) / 1024.0,
+		PackageCount: len(rows),
+		Rows:         rows,
+		PackageMap:   pkgMap,
+		AllRows:      allRows,
+		Source:       source,
+	}
+}
+
+/* ---- Lazy layer fetching ---- */
+
+// Layer annotations marking seekable layers, whose table of contents locates each file
+// in the compressed blob. podman writes the github.com-prefixed zstd:chunked key.
+var seekableLayerAnnotations = []string{
+	estargz.TOCJSONDigestAnnotation,
+	zstdchunked.ManifestChecksumAnnotation,
+	"io.github.containers.zstd-chunked.manifest-checksum",
+}
+
+// lazyLayerFetcher reads single files of seekable (eStargz, zstd:chunked) layers straight
+// from the registry with HTTP range requests, instead of pulling whole layers
+type lazyLayerFetcher struct {
+	ctx    context.Context // bounds every range request; ReadAt has no context of its own
+	repo   name.Repository
+	client *http.Client
+}
+
+func newLazyLayerFetcher(ctx context.Context, ref name.Reference, base http.RoundTripper) (*lazyLayerFetcher, error) {
+	auth, err := authn.DefaultKeychain.Resolve(ref.Context())
+	if err != nil {
+		return nil, fmt.Errorf("resolve credentials: %w", err)
+	}
+	rt, err := transport.NewWithContext(ctx, ref.Context().Registry, auth, base, []string{ref.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	return &lazyLayerFetcher{ctx: ctx, repo: ref.Context(), client: &http.Client{Transport: rt}}, nil
+}
+
+// open reads the table of contents of a seekable layer. It returns nil without error
+// for plain layers, which have to be pulled in full.
+func (f *lazyLayerFetcher) open(desc v1.Descriptor) (*estargz.Reader, error) {
+	seekable := false
+	for _, key := range seekableLayerAnnotations {
+		if desc.Annotations[key] != "" {
+			seekable = true
+		}
+	}
+	if !seekable {
+		return nil, nil
+	}
+
+	blob := &registryBlobReader{
+		ctx:    f.ctx,
+		client: f.client,
+		url: (&url.URL{
+			Scheme: f.repo.Registry.Scheme(),
+			Host:   f.repo.RegistryStr(),
+			Path:   fmt.Sprintf("/v2/%s/blobs/%s", f.repo.RepositoryStr(), desc.Digest),
+		}).String(),
+	}
+	toc, err := estargz.Open(io.NewSectionReader(blob, 0, desc.Size), estargz.WithDecompressors(new(zstdchunked.Decompressor)))
+	if err != nil {
+		return nil, err
+	}
+	// zstd:chunked annotates the compressed TOC, which the reader doesn't keep, so only
+	// eStargz TOCs can be checked; file contents are verified against the TOC either way
+	if want := desc.Annotations[estargz.TOCJSONDigestAnnotation]; want != "" {
+		if got := toc.TOCDigest().String(); got != want {
+			return nil, fmt.Errorf("table of contents digest %s does not match annotation %s", got, want)
+		}
+	}
+	return toc, nil
+}
+
+// registryBlobReader reads byte ranges of a registry blob
+type registryBlobReader struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+}
+
+func (b *registryBlobReader) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequestWithContext(b.ctx, http.MethodGet, b.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// A 200 means the registry ignored the range and is sending the whole blob
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("range request: unexpected status %s", resp.Status)
+	}
+	return io.ReadFull(resp.Body, p)
+}
+
+// walkLayer calls visit for each entry of a layer with a reader of its contents. Tar
+// readers are only valid during the call. With a table of contents an entry is only
+// fetched when its reader is read, and the reader stays valid after the walk.
+func walkLayer(ctx context.Context, layer v1.Layer, toc *estargz.Reader, visit func(hdr *tar.Header, r io.Reader)) error {
+	if toc != nil {
+		return walkLayerTOC(toc, visit)
+	}
+
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(contextReadCloser{ctx, rc})
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A corrupt cached blob usually surfaces as a tar or gzip error first; Close
+			// reports the digest mismatch that calls for a re-fetch
+			return errors.Join(err, rc.Close())
+		}
+		visit(hdr, tr)
+	}
+	// Closing a cached layer verifies its digest, which explains any read error above
+	return rc.Close()
+}
+
+// walkLayerTOC visits the entries of a seekable layer. Whiteouts come first, as they only
+// apply to lower layers, then everything else by path.
+func walkLayerTOC(toc *estargz.Reader, visit func(hdr *tar.Header, r io.Reader)) error {
+	type tocFile struct {
+		path string
+		ent  *estargz.TOCEntry
+	}
+	var files []tocFile
+	var walk func(dir string, ent *estargz.TOCEntry)
+	walk = func(dir string, ent *estargz.TOCEntry) {
+		ent.ForeachChild(func(base string, child *estargz.TOCEntry) bool {
+			p := path.Join(dir, base)
+			files = append(files, tocFile{p, child})
+			if child.Type == "dir" {
+				walk(p, child)
+			}
+			return true
+		})
+	}
+	root, ok := toc.Lookup("")
+	if !ok {
+		return errors.New("table of contents has no root directory")
+	}
+	walk("", root)
+	sort.Slice(files, func(i, j int) bool {
+		wi := strings.HasPrefix(path.Base(files[i].path), ".wh.")
+		wj := strings.HasPrefix(path.Base(files[j].path), ".wh.")
+		if wi != wj {
+			return wi
+		}
+		return files[i].path < files[j].path
+	})
+
+	var readErr error
+	for _, f := range files {
+		hdr := &tar.Header{Name: f.path, Mode: f.ent.Mode, Size: f.ent.Size, Linkname: f.ent.LinkName}
+		switch f.ent.Type {
+		case "reg":
+			hdr.Typeflag = tar.TypeReg
+		case "dir":
+			hdr.Typeflag = tar.TypeDir
+		case "symlink":
+			hdr.Typeflag = tar.TypeSymlink
+		default:
+			hdr.Typeflag = tar.TypeChar // devices and fifos: nothing to read
+		}
+		r := &tocFileReader{toc: toc, ent: f.ent, onErr: func(err error) {
+			if readErr == nil {
+				readErr = err
+			}
+		}}
+		visit(hdr, r)
+	}
+	return readErr
+}
+
+// Size of the range reads behind a tocFileReader. Each read fetches and decompresses from
+// the start of a chunk, so reads are large.
+const tocReadSize = 4 << 20
+
+// tocFileReader streams one regular file of a seekable layer, fetching on first read,
+// and checks the file against its TOC digest at EOF
+type tocFileReader struct {
+	toc   *estargz.Reader
+	ent   *estargz.TOCEntry
+	onErr func(error) // called with read failures while the walk is running
+	r     io.Reader
+	h     hash.Hash
+}
+
+func (t *tocFileReader) Read(p []byte) (int, error) {
+	if t.r == nil {
+		if t.ent.Type != "reg" {
+			return 0, io.EOF
+		}
+		sr, err := t.toc.OpenFile(t.ent.Name)
+		if err != nil {
+			return 0, t.fail(err)
+		}
+		t.r = bufio.NewReaderSize(sr, int(min(max(t.ent.Size, 16), tocReadSize)))
+		t.h = sha256.New()
+	}
+	n, err := t.r.Read(p)
+	t.h.Write(p[:n])
+	if err == io.EOF {
+		if want, herr := v1.NewHash(t.ent.Digest); herr == nil && want.Algorithm == "sha256" {
+			if got := hex.EncodeToString(t.h.Sum(nil)); got != want.Hex {
+				return n, t.fail(fmt.Errorf("digest sha256:%s does not match table of contents %s", got, want))
+			}
+		}
+	} else if err != nil {
+		err = t.fail(err)
+	}
+	return n, err
+}
+
+func (t *tocFileReader) fail(err error) error {
+	err = fmt.Errorf("%s: %w", t.ent.Name, err)
+	if t.onErr != nil {
+		t.onErr(err)
+	}
+	return err
+}
+
+// manifestCompressedSize sums the config and layer blob sizes (the pull size)
+func manifestCompressedSize(manifest *v1.Manifest) int64 {
+	total := manifest.Config.Size
+	for _, l := range manifest.Layers {
+		total += l.Size
+	}
+	return total
+}
+
+/* ---- Bounded file buffering ---- */
+
+// fileMemory caps the file contents (package databases, binaries being identified) held
+// in memory at once, across all images analyzed in parallel. Files that don't fit are
+// spilled to temp files.
+var fileMemory = &memoryBudget{limit: defaultMemoryLimit}
+
+type memoryBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+func (b *memoryBudget) setLimit(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = n
+}
+
+// max returns the budget's limit, the most any one file may be buffered with
+func (b *memoryBudget) max() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+func (b *memoryBudget) tryReserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// spooledFile holds one file's contents in memory, or in a temp file when the memory
+// budget is exhausted. Close releases either.
+type spooledFile struct {
+	data     []byte   // contents, when held in memory
+	file     *os.File // otherwise the temp file holding them
+	size     int64
+	reserved int64 // bytes of fileMemory held by data
+}
+
+// spool reads size bytes from r, in memory if the budget allows
+func spool(r io.Reader, size int64) (*spooledFile, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid file size %d", size)
+	}
+	if fileMemory.tryReserve(size) {
+		s := &spooledFile{data: make([]byte, size), size: size, reserved: size}
+		if _, err := io.ReadFull(r, s.data); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+	return spoolToDisk(r, size)
+}
+
+// spoolToDisk copies size bytes from r into a temp file
+func spoolToDisk(r io.Reader, size int64) (*spooledFile, error) {
+	f, err := os.CreateTemp("", "pkgpulse-spool-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooledFile{file: f, size: size}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spooledFile) ReadAt(p []byte, off int64) (int, error) {
+	if s.file != nil {
+		return s.file.ReadAt(p, off)
+	}
+	return bytes.NewReader(s.data).ReadAt(p, off)
+}
+
+// reader returns a fresh reader over the whole contents
+func (s *spooledFile) reader() io.Reader {
+	return io.NewSectionReader(s, 0, s.size)
+}
+
+func (s *spooledFile) Close() error {
+	if s == nil {
+		return nil
+	}
+	if s.reserved > 0 {
+		fileMemory.release(s.reserved)
+		s.reserved = 0
+	}
+	s.data = nil
+	if s.file != nil {
+		_ = s.file.Close()
+		err := os.Remove(s.file.Name())
+		s.file = nil
+		return err
+	}
+	return nil
+}
+
+// findSignature returns the first submatch of re in r. It scans a sliding window, so
+// memory stays bounded for any file size; matches must be shorter than signatureOverlap.
+func findSignature(r io.Reader, re *regexp.Regexp) []byte {
+	const window = 256 << 10
+	buf := make([]byte, 0, window+2*signatureOverlap)
+	for {
+		n, err := io.ReadFull(r, buf[len(buf):len(buf)+window])
+		buf = buf[:len(buf)+n]
+		eof := err != nil
+		// A match ending in the last overlap may continue in the next window
+		if m := re.FindSubmatchIndex(buf); m != nil && len(m) >= 4 && m[2] >= 0 && (eof || m[1] <= len(buf)-signatureOverlap) {
+			return append([]byte(nil), buf[m[2]:m[3]]...)
+		}
+		if eof {
+			return nil
+		}
+		keep := min(len(buf), 2*signatureOverlap)
+		buf = append(buf[:0], buf[len(buf)-keep:]...)
+	}
+}
+
+// unionFS tracks the final state of the files pkgpulse reads across image layers. Only
+// those files are kept, but whiteouts, opaque directories and type changes apply to
+// every path, so a database removed by whiting out a parent directory is gone too.
+type unionFS struct {
+	files   map[string]*unionFile
+	under   map[string]int // number of tracked files below each directory
+	dbCount int            // number of tracked package database files
+	layer   int            // index of the layer being applied
+}
+
+// unionFile is a tracked file: a package database or metadata file, an executable binary
+// candidate or Java archive, or a file only tracked for its size (language package contents)
+type unionFile struct {
+	layer    int
+	content  *spooledFile // database and metadata contents
+	size     int64
+	link     string // symlink target, for symlinks that can redirect tracked paths
+	database bool   // a package database file
+
+	// Binary candidates are identified as their layer streams past; candidates of lazily
+	// read layers are only fetched, through lazy, if binaries are needed at all. Ones
+	// passing while a package database is present keep their tar entry name in unread.
+	binary        bool
+	name, version string
+	lazy          io.Reader
+	unread        string
+
+	// Java archives are cataloged the same way, nested archives included
+	javaArchive bool
+	java        []pkg
+}
+
+func newUnionFS() *unionFS {
+	return &unionFS{files: make(map[string]*unionFile), under: make(map[string]int)}
+}
+
+// removeLower deletes the path and everything below it that came from lower layers
+func (u *unionFS) removeLower(p string) {
+	if f, ok := u.files[p]; ok && f.layer < u.layer {
+		u.drop(p)
+	}
+	u.removeLowerBelow(p)
+}
+
+// removeLowerBelow deletes everything below dir that came from lower layers
+func (u *unionFS) removeLowerBelow(dir string) {
+	if u.under[dir] == 0 {
+		return
+	}
+	for k, f := range u.files {
+		if f.layer < u.layer && strings.HasPrefix(k, dir+"/") {
+			u.drop(k)
+		}
+	}
+}
+
+// add tracks file at p, replacing whatever was tracked there
+func (u *unionFS) add(p string, file *unionFile) {
+	u.drop(p)
+	file.layer = u.layer
+	u.files[p] = file
+	if file.database {
+		u.dbCount++
+	}
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		u.under[dir]++
+	}
+}
+
+func (u *unionFS) drop(p string) {
+	if f, ok := u.files[p]; ok {
+		_ = f.content.Close()
+		delete(u.files, p)
+		if f.database {
+			u.dbCount--
+		}
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if u.under[dir]--; u.under[dir] == 0 {
+				delete(u.under, dir)
+			}
+		}
+	}
+}
+
+// close releases the contents of every tracked file
+func (u *unionFS) close() {
+	for p := range u.files {
+		u.drop(p)
+	}
+}
+
+// resolve follows tracked symlinks in the directories of p, and in p itself when
+// followLast, the way a runtime resolves a layer entry while extracting it
+func (u *unionFS) resolve(p string, followLast bool) string {
+	for hops := 0; hops < 40; hops++ { // symlink loops give up like ELOOP
+		parts := strings.Split(p, "/")
+		last := len(parts)
+		if !followLast {
+			last--
+		}
+		redirected := false
+		for i := 1; i <= last; i++ {
+			prefix := strings.Join(parts[:i], "/")
+			f, ok := u.files[prefix]
+			if !ok || f.link == "" {
+				continue
+			}
+			// Relative targets are relative to the link's directory; neither kind escapes the root
+			target := f.link
+			if !path.IsAbs(target) {
+				target = path.Join(path.Dir(prefix), target)
+			}
+			target = strings.TrimPrefix(path.Clean("/"+target), "/")
+			p = path.Join(target, strings.Join(parts[i:], "/"))
+			redirected = true
+			break
+		}
+		if !redirected {
+			break
+		}
+	}
+	return p
+}
+
+// lookup returns the tracked regular file at p, following symlinks
+func (u *unionFS) lookup(p string) (*unionFile, bool) {
+	f, ok := u.files[u.resolve(p, true)]
+	if !ok || f.content == nil {
+		return nil, false
+	}
+	return f, true
+}
+
+// apply records one layer entry: whiteouts and opaque markers remove lower files, and any
+// entry replaces what was at its path. p has its directories resolved already; file is
+// nil for entries that aren't tracked.
+func (u *unionFS) apply(hdr *tar.Header, p string, file *unionFile) {
+	dir, base := path.Split(p)
+	dir = strings.TrimSuffix(dir, "/")
+	if base == ".wh..wh..opq" {
+		u.removeLowerBelow(dir)
+		return
+	}
+	if target, found := strings.CutPrefix(base, ".wh."); found {
+		u.removeLower(path.Join(dir, target))
+		return
+	}
+
+	if hdr.Typeflag == tar.TypeDir {
+		// A directory replaces a file, but merges with a lower directory
+		if f, ok := u.files[p]; ok && f.layer < u.layer {
+			u.drop(p)
+		}
+		return
+	}
+	u.removeLower(p)
+	if file != nil {
+		u.add(p, file) // the same layer may list a path twice
+	}
+}
+
+// databases collects the final package database files; they stay owned by the union
+func (u *unionFS) databases() packageDatabases {
+	dbs := packageDatabases{dpkgStatusParts: make(map[string]*spooledFile)}
+	if f, ok := u.lookup(apkDBPath); ok {
+		dbs.apk = f.content
+	}
+	if f, ok := u.lookup(dpkgDBPath); ok {
+		dbs.dpkg = f.content
+	}
+	statusDir := u.resolve(dpkgStatusDir, true) + "/"
+	pacmanDir := u.resolve(pacmanLocalDir, true)
+	for p, f := range u.files {
+		switch {
+		case f.content == nil:
+		case strings.HasPrefix(p, statusDir):
+			dbs.dpkgStatusParts[p] = f.content
+		case isPacmanDescPath(pacmanDir, p):
+			if dbs.pacman == nil {
+				dbs.pacman = make(map[string]*spooledFile)
+			}
+			dbs.pacman[p] = f.content
+		}
+	}
+
+	// If several RPM databases survive (a stale one next to a migrated one), the one
+	// written last is current; ties go to the newer format, then the newer location
+	rpmLayer := -1
+	for _, db := range rpmDBFiles {
+		for _, dir := range rpmDBDirs {
+			if f, ok := u.lookup(dir + "/" + db.name); ok && f.layer > rpmLayer {
+				dbs.rpm = f.content
+				dbs.rpmFormat = db.format
+				rpmLayer = f.layer
+			}
+		}
+	}
+	return dbs
+}
+
+// identifyUnreadBinaries identifies the executables that streamed past unread while a
+// package database was present, for images where a later layer removed every database.
+// Only the layers holding them are read again.
+func identifyUnreadBinaries(ctx context.Context, layers []v1.Layer, union *unionFS, logProgress func(string)) error {
+	unread := make(map[int]map[string]*unionFile)
+	for _, f := range union.files {
+		if f.binary && f.unread != "" {
+			if unread[f.layer] == nil {
+				unread[f.layer] = make(map[string]*unionFile)
+			}
+			unread[f.layer][f.unread] = f
+		}
+	}
+	if len(unread) == 0 {
+		return nil
+	}
+	logProgress(fmt.Sprintf("no package database left, re-reading %d layers to identify binaries", len(unread)))
+	for i, files := range unread {
+		err := walkLayer(ctx, layers[i], nil, func(hdr *tar.Header, r io.Reader) {
+			f, ok := files[hdr.Name]
+			if !ok || hdr.Typeflag != tar.TypeReg {
+				return
+			}
+			if content, err := spool(r, hdr.Size); err == nil {
+				p := strings.TrimPrefix(strings.TrimPrefix(hdr.Name, "/"), "./")
+				f.name, f.version = identifyBinary(p, content, hdr.Size)
+				f.unread = ""
+				_ = content.Close()
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("layer %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// binaries returns one package per identified executable, in path order. Executables
+// that could not be read again (see identifyUnreadBinaries) are known only by file name.
+func (u *unionFS) binaries() []pkg {
+	paths := make([]string, 0, len(u.files))
+	for p, f := range u.files {
+		if f.binary {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var packages []pkg
+	seenNames := make(map[string]struct{})
+	for _, p := range paths {
+		f := u.files[p]
+		if f.lazy != nil {
+			content, err := spool(f.lazy, f.size)
+			if err != nil {
+				continue
+			}
+			f.name, f.version = identifyBinary(p, content, f.size)
+			_ = content.Close()
+		}
+		if f.unread != "" {
+			f.name, f.version = filepath.Base(p), "-"
+		}
+		if _, exists := seenNames[f.name]; exists {
+			continue
+		}
+		seenNames[f.name] = struct{}{}
+		packages = append(packages, pkg{
+			Name:    f.name,
+			Version: f.version,
+			SizeKB:  f.size / 1024,
+			Type:    "binary",
+		})
+	}
+	return packages
+}
+
+// isPackageDatabasePath reports whether the file at p is read by the package parsers
+func isPackageDatabasePath(p string) bool {
+	if p == apkDBPath || p == dpkgDBPath || isRPMDBPath(p) || isPacmanDescPath(pacmanLocalDir, p) {
+		return true
+	}
+	return strings.HasPrefix(p, dpkgStatusDir+"/") && !strings.HasSuffix(p, ".md5sums") &&
+		!strings.HasPrefix(path.Base(p), ".wh.")
+}
+
+// isPacmanDescPath reports whether p is a package's desc file in the pacman database at dir
+func isPacmanDescPath(dir, p string) bool {
+	pkgDir, ok := strings.CutSuffix(p, "/desc")
+	return ok && path.Dir(pkgDir) == dir && !strings.HasPrefix(path.Base(pkgDir), ".wh.")
+}
+
+func isRPMDBPath(p string) bool {
+	_, _, ok := rpmDBAt(p)
+	return ok
+}
+
+// rpmDBAt reports whether p is an RPM database, with its format and a rank for choosing
+// between several: lower ranks are newer formats, then newer locations
+func rpmDBAt(p string) (format string, rank int, ok bool) {
+	dir, base := path.Split(p)
+	di := slices.Index(rpmDBDirs, strings.TrimSuffix(dir, "/"))
+	if di < 0 {
+		return "", 0, false
+	}
+	for fi, db := range rpmDBFiles {
+		if db.name == base {
+			return db.format, fi*len(rpmDBDirs) + di, true
+		}
+	}
+	return "", 0, false
+}
+
+// isTrackedLinkPath reports whether a symlink at p can redirect the paths pkgpulse reads:
+// a package database, or a directory holding them or one of its parents
+func isTrackedLinkPath(p string) bool {
+	if isPackageDatabasePath(p) {
+		return true
+	}
+	dirs := append([]string{path.Dir(apkDBPath), path.Dir(dpkgDBPath), dpkgStatusDir, pacmanLocalDir}, rpmDBDirs...)
+	for _, dir := range append(dirs, binaryCandidateDirs...) {
+		if dir == p || strings.HasPrefix(dir, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// extractPackagesFromImage reads package databases from image layers in a single pass,
+// identifying executable binaries as they stream past, and catalogs the packages of the
+// given languages (--languages). With a lazy fetcher, seekable layers are read file by
+// file instead of being pulled in full.
+// A non-nil error means some layer could not be read completely; whatever was found is
+// still returned.
+func extractPackagesFromImage(ctx context.Context, img v1.Image, lazy *lazyLayerFetcher, languages []string, logProgress func(message string, currentLayer, totalLayers int64)) ([]pkg, error) {
+	python := slices.Contains(languages, langPython)
+	npm := slices.Contains(languages, langNPM)
+	java := slices.Contains(languages, langJava)
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, fmt.Errorf("get layers: %w", err)
+	}
+	var scanErr error
+
+	totalLayers := len(layers)
+	logProgress(fmt.Sprintf("scanning %d layers", totalLayers), 0, int64(totalLayers))
+
+	// Tables of contents of the layers that can be read lazily; nil entries are pulled
+	tocs := make([]*estargz.Reader, totalLayers)
+	if lazy != nil {
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, fmt.Errorf("read manifest: %w", err)
+		}
+		for i, desc := range manifest.Layers {
+			if i >= totalLayers {
+				break
+			}
+			toc, err := lazy.open(desc)
+			if err != nil {
+				logProgress(fmt.Sprintf("layer %d/%d: lazy fetch unavailable, pulling in full: %v", i+1, totalLayers, err), int64(i+1), int64(totalLayers))
+			}
+			tocs[i] = toc
+		}
+	}
+
+	// Apply layers in order, so the union holds the final state of every tracked file
+	union := newUnionFS()
+	defer union.close()
+	for i, layer := range layers {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		msg := fmt.Sprintf("layer %d/%d", i+1, totalLayers)
+		if tocs[i] != nil {
+			msg += " (lazy)"
+		}
+		logProgress(msg, int64(i+1), int64(totalLayers))
+
+		union.layer = i
+		lazyLayer := tocs[i] != nil
+		err := walkLayer(ctx, layer, tocs[i], func(hdr *tar.Header, r io.Reader) {
+			// Normalize path (remove leading /)
+			path := strings.TrimPrefix(hdr.Name, "/")
+			path = strings.TrimPrefix(path, "./")
+			path = strings.TrimSuffix(path, "/")
+
+			// Entries written through a symlinked directory (var/lib/rpm pointing at
+			// usr/lib/sysimage/rpm) land where the symlink points. Either name counts.
+			resolved := union.resolve(path, false)
+			is := func(match func(string) bool) bool { return match(path) || match(resolved) }
+
+			var file *unionFile
+			switch {
+			case hdr.Typeflag == tar.TypeSymlink:
+				if is(isTrackedLinkPath) {
+					file = &unionFile{link: hdr.Linkname}
+				}
+			case hdr.Typeflag != tar.TypeReg:
+			case is(isPackageDatabasePath):
+				// RPM databases are opened from a file anyway, so they always go to disk
+				var content *spooledFile
+				var err error
+				if is(isRPMDBPath) {
+					content, err = spoolToDisk(r, hdr.Size)
+				} else {
+					content, err = spool(r, hdr.Size)
+				}
+				if err == nil {
+					file = &unionFile{content: content, size: hdr.Size, database: true}
+				}
+			case hdr.Mode&0111 != 0 && hdr.Size > 0 && is(func(p string) bool { return isBinaryCandidateDir(filepath.Dir(p)) }):
+				file = &unionFile{binary: true, size: hdr.Size}
+				if lazyLayer {
+					file.lazy = r
+				} else if union.dbCount > 0 {
+					// Binaries are only reported without package databases, so while one is
+					// present they aren't read; identifyUnreadBinaries reads them if a later
+					// layer removes it
+					file.unread = hdr.Name
+				} else if content, err := spool(r, hdr.Size); err == nil {
+					file.name, file.version = identifyBinary(path, content, hdr.Size)
+					_ = content.Close()
+				} else {
+					file = nil
+				}
+			case python && isSitePackagesPath(resolved), npm && isNodeModulesPath(resolved):
+				// Only metadata is read; everything else is tracked for its size
+				file = &unionFile{size: hdr.Size}
+				if isPythonMetadataPath(resolved) || isNpmManifestPath(resolved) {
+					if content, err := spool(r, hdr.Size); err == nil {
+						file.content = content
+					} else {
+						file = nil
+					}
+				}
+			case java && hdr.Size > 0 && isJavaArchivePath(resolved) && !isJavaSystemPath(resolved):
+				file = &unionFile{javaArchive: true, size: hdr.Size}
+				if lazyLayer {
+					file.lazy = r
+				} else if content, err := spool(r, hdr.Size); err == nil {
+					file.java = catalogJavaArchive(resolved, content, hdr.Size, hdr.Size, 0)
+					_ = content.Close()
+				} else {
+					file = nil
+				}
+			}
+			union.apply(hdr, resolved, file)
+		})
+		if err != nil {
+			scanErr = fmt.Errorf("layer %d: %w", i+1, err)
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, context.Cause(ctx)
+	}
+
+	// Parse the databases we found
+	packages := parsePackageDatabases(union.databases(), func(message string) {
+		logProgress(message, int64(totalLayers), int64(totalLayers))
+	})
+
+	// If no OS packages found, report the executables of the final filesystem state
+	if len(packages) == 0 {
+		if err := identifyUnreadBinaries(ctx, layers, union, func(message string) {
+			logProgress(message, int64(totalLayers), int64(totalLayers))
+		}); err != nil {
+			scanErr = errors.Join(scanErr, err)
+		}
+		if binaries := union.binaries(); len(binaries) > 0 {
+			logProgress(fmt.Sprintf("found %d executable binaries", len(binaries)), int64(totalLayers), int64(totalLayers))
+			packages = append(packages, binaries...)
+		}
+	}
+
+	if python {
+		pkgs := union.pythonPackages()
+		logProgress(fmt.Sprintf("found %d python packages", len(pkgs)), int64(totalLayers), int64(totalLayers))
+		packages = append(packages, pkgs...)
+	}
+	if npm {
+		pkgs := union.npmPackages()
+		logProgress(fmt.Sprintf("found %d npm packages", len(pkgs)), int64(totalLayers), int64(totalLayers))
+		packages = append(packages, pkgs...)
+	}
+	if java {
+		pkgs := union.javaPackages()
+		logProgress(fmt.Sprintf("found %d java packages", len(pkgs)), int64(totalLayers), int64(totalLayers))
+		packages = append(packages, pkgs...)
+	}
+
+	return packages, scanErr
+}
+
+// parsePackageDatabases parses the final-state databases collected from a filesystem
+func parsePackageDatabases(dbs packageDatabases, logProgress func(message string)) []pkg {
+	var packages []pkg
+
+	var dpkgData io.Reader
+	dpkgFromStatusDir := false
+	if dbs.dpkg != nil && dbs.dpkg.size > 0 {
+		dpkgData = dbs.dpkg.reader()
+	} else if len(dbs.dpkgStatusParts) > 0 {
+		logProgress(fmt.Sprintf("combining %d dpkg status.d entries", len(dbs.dpkgStatusParts)))
+		dpkgData = combineDpkgStatusParts(dbs.dpkgStatusParts)
+		dpkgFromStatusDir = true
+	}
+
+	if dbs.apk != nil && dbs.apk.size > 0 {
+		logProgress("parsing apk database")
+		pkgs := parseAPKDB(dbs.apk.reader())
+		packages = append(packages, pkgs...)
+		logProgress(fmt.Sprintf("found %d apk packages", len(pkgs)))
+	}
+	if dpkgData != nil {
+		logProgress("parsing dpkg database")
+		pkgs := parseDpkgDB(dpkgData, dpkgFromStatusDir)
+		packages = append(packages, pkgs...)
+		logProgress(fmt.Sprintf("found %d deb packages", len(pkgs)))
+	}
+	if dbs.rpm != nil && dbs.rpm.size > 0 {
+		logProgress(fmt.Sprintf("parsing rpm database (%s)", dbs.rpmFormat))
+		pkgs := parseRPMDB(dbs.rpm.file.Name(), dbs.rpmFormat)
+		packages = append(packages, pkgs...)
+		logProgress(fmt.Sprintf("found %d rpm packages", len(pkgs)))
+	}
+	if len(dbs.pacman) > 0 {
+		logProgress(fmt.Sprintf("parsing pacman database (%d entries)", len(dbs.pacman)))
+		descPaths := make([]string, 0, len(dbs.pacman))
+		for p := range dbs.pacman {
+			descPaths = append(descPaths, p)
+		}
+		sort.Strings(descPaths)
+		var pkgs []pkg
+		for _, p := range descPaths {
+			if desc, ok := parsePacmanDesc(dbs.pacman[p].reader()); ok {
+				pkgs = append(pkgs, desc)
+			}
+		}
+		packages = append(packages, pkgs...)
+		logProgress(fmt.Sprintf("found %d pacman packages", len(pkgs)))
+	}
+
+	return packages
+}
+
+// extractPackagesFromDir reads package databases from an unpacked root filesystem
+func extractPackagesFromDir(ctx context.Context, root string, languages []string, logProgress func(message string, current, total int64)) ([]pkg, error) {
+	python := slices.Contains(languages, langPython)
+	npm := slices.Contains(languages, langNPM)
+	java := slices.Contains(languages, langJava)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("read rootfs: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("rootfs %s is not a directory", root)
+	}
+
+	logProgress("walking root filesystem", 0, 0)
+
+	dbs := packageDatabases{dpkgStatusParts: make(map[string]*spooledFile)}
+	defer dbs.close()
+	rpmRank := -1
+	binaries := make(map[string]int64) // path -> size
+	langFiles := newUnionFS()          // language package metadata and contents
+	defer langFiles.close()
+	var javaPkgs []pkg // Java archives, in walk (path) order
+	var fileCount int64
+
+	err = filepath.WalkDir(root, func(fullPath string, d fs.DirEntry, walkErr error) error {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if walkErr != nil {
+			// Skip unreadable subtrees (common for exported rootfs owned by root)
+			if d != nil && d.IsDir() && fullPath != root {
+				return fs.SkipDir
+			}
+			return walkErr
+		}
+		// Only regular files: symlinks may point outside the rootfs
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return nil
+		}
+		path := filepath.ToSlash(rel)
+
+		fileCount++
+		if fileCount%5000 == 0 {
+			logProgress(fmt.Sprintf("scanned %d files", fileCount), 0, 0)
+		}
+
+		if (python && isSitePackagesPath(path)) || (npm && isNodeModulesPath(path)) {
+			file := &unionFile{}
+			if fi, err := d.Info(); err == nil {
+				file.size = fi.Size()
+			}
+			if isPythonMetadataPath(path) || isNpmManifestPath(path) {
+				if file.content = spoolPath(fullPath, false); file.content == nil {
+					return nil
+				}
+			}
+			langFiles.add(path, file)
+			return nil
+		}
+
+		if java && isJavaArchivePath(path) && !isJavaSystemPath(path) {
+			// Archives are read in place; only nested ones are buffered
+			if f, err := os.Open(fullPath); err == nil {
+				if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+					javaPkgs = append(javaPkgs, catalogJavaArchive(path, f, fi.Size(), fi.Size(), 0)...)
+				}
+				_ = f.Close()
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(path, dpkgStatusDir+"/") {
+			if !strings.HasSuffix(path, ".md5sums") {
+				if part := spoolPath(fullPath, false); part != nil {
+					dbs.dpkgStatusParts[path] = part
+				}
+			}
+			return nil
+		}
+
+		if isPacmanDescPath(pacmanLocalDir, path) {
+			if desc := spoolPath(fullPath, false); desc != nil {
+				if dbs.pacman == nil {
+					dbs.pacman = make(map[string]*spooledFile)
+				}
+				dbs.pacman[path] = desc
+			}
+			return nil
+		}
+
+		switch path {
+		case apkDBPath:
+			dbs.apk = spoolPath(fullPath, false)
+		case dpkgDBPath:
+			dbs.dpkg = spoolPath(fullPath, false)
+		default:
+			// Symlinked database directories aren't followed; their targets are walked anyway
+			if format, rank, ok := rpmDBAt(path); ok {
+				if rpmRank < 0 || rank < rpmRank {
+					if rpm := spoolPath(fullPath, true); rpm != nil {
+						_ = dbs.rpm.Close()
+						dbs.rpm, dbs.rpmFormat, rpmRank = rpm, format, rank
+					}
+				}
+				return nil
+			}
+			if isBinaryCandidateDir(filepath.Dir(path)) {
+				if fi, err := d.Info(); err == nil && fi.Mode()&0111 != 0 && fi.Size() > 0 {
+					binaries[path] = fi.Size()
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk rootfs: %w", err)
+	}
+
+	packages := parsePackageDatabases(dbs, func(message string) {
+		logProgress(message, 0, 0)
+	})
+
+	if len(packages) == 0 && len(binaries) > 0 {
+		logProgress(fmt.Sprintf("checking %d executable binaries", len(binaries)), 0, 0)
+		packages = append(packages, detectBinaryPackagesInDir(root, binaries)...)
+	}
+
+	if python {
+		pkgs := langFiles.pythonPackages()
+		logProgress(fmt.Sprintf("found %d python packages", len(pkgs)), 0, 0)
+		packages = append(packages, pkgs...)
+	}
+	if npm {
+		pkgs := langFiles.npmPackages()
+		logProgress(fmt.Sprintf("found %d npm packages", len(pkgs)), 0, 0)
+		packages = append(packages, pkgs...)
+	}
+	if len(javaPkgs) > 0 {
+		pkgs := mergePackageCopies(javaPkgs)
+		logProgress(fmt.Sprintf("found %d java packages", len(pkgs)), 0, 0)
+		packages = append(packages, pkgs...)
+	}
+
+	return packages, nil
+}
+
+// spoolPath copies a rootfs file into a spooledFile (on disk when toDisk), or returns nil
+// if it can't be read
+func spoolPath(fullPath string, toDisk bool) *spooledFile {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	var content *spooledFile
+	if toDisk {
+		content, err = spoolToDisk(f, info.Size())
+	} else {
+		content, err = spool(f, info.Size())
+	}
+	if err != nil {
+		return nil
+	}
+	return content
+}
+
+// parseRPMDB parses RPM database using go-rpmdb (supports SQLite, BerkeleyDB, NDB)
+// dbPath is a private copy (go-rpmdb needs a file path, and sqlite may write next to it)
+func parseRPMDB(dbPath string, format string) []pkg {
+	// Open RPM database
+	db, err := rpmdb.Open(dbPath)
+	if err != nil {
+		log.Printf("Warning: could not open RPM DB (%s): %v", format, err)
+		return nil
+	}
+	defer func() { _ = db.Close() }()
+
+	// List packages
+	pkgList, err := db.ListPackages()
+	if err != nil {
+		log.Printf("Warning: could not list RPM packages: %v", err)
+		return nil
+	}
+
+	var packages []pkg
+	for _, p := range pkgList {
+		if p.Name != "" {
+			packages = append(packages, pkg{
+				Name:    p.Name,
+				Version: fmt.Sprintf("%s-%s", p.Version, p.Release),
+				SizeKB:  int64(p.Size) / 1024,
+				Type:    "rpm",
+				Arch:    p.Arch,
+				License: p.License,
+			})
+		}
+	}
+
+	return packages
+}
+
+// detectBinaryPackagesInDir inspects executable files of an unpacked rootfs
+func detectBinaryPackagesInDir(root string, candidates map[string]int64) []pkg {
+	paths := make([]string, 0, len(candidates))
+	for path := range candidates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var packages []pkg
+	seenNames := make(map[string]struct{})
+	for _, path := range paths {
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(path)))
+		if err != nil {
+			continue
+		}
+		name, version := identifyBinary(path, f, candidates[path])
+		_ = f.Close()
+		if _, exists := seenNames[name]; exists {
+			continue
+		}
+		seenNames[name] = struct{}{}
+		packages = append(packages, pkg{
+			Name:    name,
+			Version: version,
+			SizeKB:  candidates[path] / 1024,
+			Type:    "binary",
+		})
+	}
+	return packages
+}
+
+// identifyBinary derives a package name and version from an executable's contents,
+// reading only the parts it needs
+func identifyBinary(path string, r io.ReaderAt, size int64) (name, version string) {
+	name = filepath.Base(path)
+	version = "-"
+
+	// BusyBox applets may be named as individual commands ("[", "sh", etc.).
+	// Normalize these to a single "busybox" package when signature is present.
+	if match := findSignature(io.NewSectionReader(r, 0, size), busyBoxVersionRe); match != nil {
+		name = "busybox"
+		version = string(match)
+	}
+
+	// Try Go build info first.
+	if info, err := buildinfo.Read(r); err == nil {
+		version = info.GoVersion
+		if info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+	} else if name == "getconf" {
+		// libc-bin/getconf embeds glibc version strings in binaries.
+		if match := findSignature(io.NewSectionReader(r, 0, size), debianGLIBCVersionRe); match != nil {
+			version = string(match)
+		} else if match := findSignature(io.NewSectionReader(r, 0, size), glibcSymbolVersionRe); match != nil {
+			version = string(match)
+		}
+	}
+
+	return name, version
+}
+
+// isBinaryCandidateDir reports whether executables in dir are inspected for binary packages
+func isBinaryCandidateDir(dir string) bool {
+	return slices.Contains(binaryCandidateDirs, dir)
+}
+
+// parseAPKDB parses Alpine's /lib/apk/db/installed format
+func parseAPKDB(r io.Reader) []pkg {
+	var packages []pkg
+	current := pkg{Type: "apk"}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			// End of package entry
+			if current.Name != "" {
+				packages = append(packages, current)
+			}
+			current = pkg{Type: "apk"}
+			continue
+		}
+
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+
+		key := line[0]
+		value := line[2:]
+
+		switch key {
+		case 'P': // Package name
+			current.Name = value
+		case 'V': // Version
+			current.Version = value
+		case 'I': // Installed size (bytes)
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.SizeKB = size / 1024
+			}
+		case 'A': // Architecture
+			current.Arch = value
+		case 'L': // License
+			current.License = value
+		case 'S': // Package size (fallback if I not present)
+			if current.SizeKB == 0 {
+				if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+					current.SizeKB = size / 1024
+				}
+			}
+		}
+	}
+
+	// Don't forget last package
+	if current.Name != "" {
+		packages = append(packages, current)
+	}
+
+	return packages
+}
+
+// combineDpkgStatusParts streams status.d fragments as one status file, in name order,
+// each terminated by a blank line
+func combineDpkgStatusParts(parts map[string]*spooledFile) io.Reader {
+	keys := make([]string, 0, len(parts))
+	for k := range parts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var readers []io.Reader
+	for _, k := range keys {
+		part := parts[k]
+		if part.size == 0 {
+			continue
+		}
+		readers = append(readers, part.reader())
+		last := make([]byte, 1)
+		if _, err := part.ReadAt(last, part.size-1); err != nil || last[0] != '\n' {
+			readers = append(readers, strings.NewReader("\n"))
+		}
+		readers = append(readers, strings.NewReader("\n"))
+	}
+	return io.MultiReader(readers...)
+}
+
+// parseDpkgDB parses Debian's /var/lib/dpkg/status format.
+// If assumeInstalled is true, entries without a Status line are treated as installed.
+func parseDpkgDB(r io.Reader, assumeInstalled bool) []pkg {
+	var packages []pkg
+	current := pkg{Type: "deb"}
+	var isInstalled bool
+	var statusSeen bool
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "" {
+			// End of package entry
+			if current.Name != "" && (isInstalled || (assumeInstalled && !statusSeen)) {
+				packages = append(packages, current)
+			}
+			current = pkg{Type: "deb"}
+			isInstalled = false
+			statusSeen = false
+			continue
+		}
+
+		// Handle continuation lines (start with space)
+		if strings.HasPrefix(line, " ") {
+			continue
+		}
+
+		idx := strings.Index(line, ": ")
+		if idx == -1 {
+			continue
+		}
+
+		key := line[:idx]
+		value := line[idx+2:]
+
+		switch key {
+		case "Package":
+			current.Name = value
+		case "Version":
+			current.Version = value
+		case "Installed-Size":
+			// dpkg stores size in KB
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
+				current.SizeKB = size
+			}
+		case "Architecture":
+			current.Arch = value
+		case "Status":
+			// Only count installed packages
+			isInstalled = strings.Contains(value, "installed")
+			statusSeen = true
+		}
+	}
+
+	// Don't forget last package
+	if current.Name != "" && (isInstalled || (assumeInstalled && !statusSeen)) {
+		packages = append(packages, current)
+	}
+
+	return packages
+}
+
+// parsePacmanDesc parses one package of Arch's local pacman database
+// (var/lib/pacman/local/<name>-<version>/desc): %FIELD% headers, each followed by its
+// values one per line and a blank line
+func parsePacmanDesc(r io.Reader) (pkg, bool) {
+	p := pkg{Type: "pacman"}
+	var field string
+	var licenses []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			field = ""
+		case len(line) > 2 && strings.HasPrefix(line, "%") && strings.HasSuffix(line, "%"):
+			field = line
+		default:
+			switch field {
+			case "%NAME%":
+				p.Name = line
+			case "%VERSION%":
+				p.Version = line
+			case "%SIZE%": // Installed size (bytes)
+				if size, err := strconv.ParseInt(line, 10, 64); err == nil {
+					p.SizeKB = size / 1024
+				}
+			case "%ARCH%":
+				p.Arch = line
+			case "%LICENSE%":
+				licenses = append(licenses, line)
+			}
+		}
+	}
+	// A package lists one license per line, each covering part of its files
+	p.License = strings.Join(licenses, " AND ")
+
+	return p, p.Name != ""
+}
+
+/* ---- Language packages ---- */
+
+const (
+	langJava   = "java"
+	langNPM    = "npm"
+	langPython = "python"
+)
+
+// supportedLanguages lists the language package ecosystems --languages can enable
+var supportedLanguages = []string{langJava, langNPM, langPython}
+
+// pythonSystemDir holds the Debian-packaged Python modules, which dpkg already reports
+const pythonSystemDir = "usr/lib/python3/dist-packages"
+
+// isSitePackagesPath reports whether p is inside a Python site-packages directory
+func isSitePackagesPath(p string) bool {
+	return strings.Contains(p, "/site-packages/") || strings.Contains(p, "/dist-packages/")
+}
+
+// isPythonMetadataPath reports whether p is one of the metadata files read from an
+// installed distribution's .dist-info or .egg-info directory
+func isPythonMetadataPath(p string) bool {
+	dir, base := path.Split(strings.TrimPrefix(p, "/"))
+	dir = strings.TrimSuffix(dir, "/")
+	if site := path.Base(path.Dir(dir)); site != "site-packages" && site != "dist-packages" {
+		return false
+	}
+	switch {
+	case strings.HasSuffix(dir, ".dist-info"):
+		return base == "METADATA" || base == "RECORD" || base == "INSTALLER"
+	case strings.HasSuffix(dir, ".egg-info"):
+		return base == "PKG-INFO" || base == "installed-files.txt" || base == "top_level.txt" || base == "INSTALLER"
+	}
+	return false
+}
+
+// pythonPackages returns one package per distribution name in site-packages, in path
+// order, with copies in several environments merged. Distributions installed by the OS
+// package manager are left to it.
+func (u *unionFS) pythonPackages() []pkg {
+	dists := make(map[string]map[string]*spooledFile) // dist dir -> metadata file -> content
+	for p, f := range u.files {
+		if f.content == nil || !isPythonMetadataPath(p) {
+			continue
+		}
+		dir := path.Dir(p)
+		if dists[dir] == nil {
+			dists[dir] = make(map[string]*spooledFile)
+		}
+		dists[dir][path.Base(p)] = f.content
+	}
+	dirs := make([]string, 0, len(dists))
+	for dir := range dists {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var packages []pkg
+	for _, dir := range dirs {
+		meta := dists[dir]
+		if strings.HasPrefix(dir, pythonSystemDir+"/") {
+			continue
+		}
+		if installer, ok := meta["INSTALLER"]; ok {
+			data, _ := io.ReadAll(installer.reader())
+			switch strings.TrimSpace(string(data)) {
+			case "rpm", "dpkg", "debian", "apk", "pacman":
+				continue
+			}
+		}
+
+		info, ok := meta["METADATA"]
+		if !ok {
+			info, ok = meta["PKG-INFO"]
+		}
+		if !ok {
+			continue
+		}
+		p, ok := parsePythonMetadata(info.reader())
+		if !ok {
+			continue
+		}
+		p.SizeKB = u.pythonDistSize(dir, meta) / 1024
+		packages = append(packages, p)
+	}
+	return mergePackageCopies(packages)
+}
+
+// pythonDistSize totals the files a distribution installed: those listed in its RECORD
+// (or an egg's installed-files.txt) that are still present, or failing both, its metadata
+// directory and top-level modules
+func (u *unionFS) pythonDistSize(dir string, meta map[string]*spooledFile) int64 {
+	siteDir := path.Dir(dir)
+	seen := make(map[string]bool)
+	var total int64
+	// Files in site-packages are tracked, so one missing from the union was removed by a
+	// later layer; files elsewhere (console scripts) are taken at their recorded size
+	count := func(p string, recorded int64) {
+		p = strings.TrimPrefix(p, "/")
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		if isSitePackagesPath(p) {
+			if f, ok := u.files[p]; ok && f.link == "" {
+				total += f.size
+			}
+			return
+		}
+		total += recorded
+	}
+
+	if record, ok := meta["RECORD"]; ok {
+		// Each row is path,hash,size; the size is empty for RECORD itself and .pyc files
+		cr := csv.NewReader(record.reader())
+		cr.FieldsPerRecord = -1
+		cr.LazyQuotes = true
+		for {
+			fields, err := cr.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if _, ok := err.(*csv.ParseError); ok {
+					continue
+				}
+				break
+			}
+			if len(fields) == 0 || fields[0] == "" {
+				continue
+			}
+			var size int64
+			if len(fields) >= 3 {
+				size, _ = strconv.ParseInt(fields[2], 10, 64)
+			}
+			p := fields[0]
+			if !path.IsAbs(p) {
+				p = path.Join(siteDir, p)
+			}
+			count(p, size)
+		}
+		return total
+	}
+
+	if files, ok := meta["installed-files.txt"]; ok {
+		scanner := bufio.NewScanner(files.reader())
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				count(path.Join(dir, line), 0)
+			}
+		}
+		return total
+	}
+
+	prefixes := []string{dir + "/"}
+	if topLevel, ok := meta["top_level.txt"]; ok {
+		scanner := bufio.NewScanner(topLevel.reader())
+		for scanner.Scan() {
+			if module := strings.TrimSpace(scanner.Text()); module != "" {
+				prefixes = append(prefixes, path.Join(siteDir, module)+"/", path.Join(siteDir, module)+".py")
+			}
+		}
+	}
+	for p := range u.files {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(p, prefix) {
+				count(p, 0)
+				break
+			}
+		}
+	}
+	return total
+}
+
+// mergePackageCopies folds the copies of a package installed at several paths (venvs,
+// nested node_modules, archives bundled in several others) into the first one, since
+// results are keyed by name within an ecosystem: sizes add up, Version becomes the
+// newest and Versions lists the distinct versions oldest first
+func mergePackageCopies(packages []pkg) []pkg {
+	var merged []pkg
+	index := make(map[string]int)
+	versions := make(map[string][]string)
+	for _, p := range packages {
+		if p.Version != "" && !slices.Contains(versions[p.Name], p.Version) {
+			versions[p.Name] = append(versions[p.Name], p.Version)
+		}
+		i, ok := index[p.Name]
+		if !ok {
+			index[p.Name] = len(merged)
+			merged = append(merged, p)
+			continue
+		}
+		merged[i].SizeKB += p.SizeKB
+		merged[i].License = cmp.Or(merged[i].License, p.License)
+	}
+	for i := range merged {
+		p := &merged[i]
+		if vs := versions[p.Name]; len(vs) > 1 {
+			slices.SortFunc(vs, func(a, b string) int { return comparePackageVersions(p.Type, a, p.Type, b) })
+			p.Version, p.Versions = vs[len(vs)-1], vs
+		}
+	}
+	return merged
+}
 
-	case "rm":
-		if len(args) < 2 {
-			log.Fatalf("usage: pkgpulse cache rm <image>")
+// parsePythonMetadata parses the header block of a METADATA or PKG-INFO file
+// (core metadata, an email-style header format)
+func parsePythonMetadata(r io.Reader) (pkg, bool) {
+	p := pkg{Type: langPython}
+	var license, classifierLicense string
+	licenseContinued := false
+	field := ""
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			break // the description body follows the headers
 		}
-		if err := removeCacheEntry(args[1]); err != nil {
-			log.Fatalf("remove cache entry: %v", err)
+		if line[0] == ' ' || line[0] == '\t' {
+			if field == "license" {
+				licenseContinued = true
+			}
+			continue
 		}
-		fmt.Printf("Removed %s from cache\n", args[1])
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		field = strings.ToLower(key)
+		value = strings.TrimSpace(value)
+		switch field {
+		case "name":
+			p.Name = value
+		case "version":
+			p.Version = value
+		case "license-expression":
+			p.License = value
+		case "license":
+			license = value
+		case "classifier":
+			// License :: OSI Approved :: MIT License
+			if strings.HasPrefix(value, "License :: ") && classifierLicense == "" {
+				classifierLicense = value[strings.LastIndex(value, " :: ")+len(" :: "):]
+			}
+		}
+	}
 
-	case "path":
-		fmt.Println(getCacheDir())
+	// License often holds the full license text, which is no use in a table
+	if p.License == "" && license != "" && license != "UNKNOWN" && !licenseContinued {
+		p.License = license
+	}
+	if p.License == "" {
+		p.License = classifierLicense
+	}
+	return p, p.Name != "" && p.Version != ""
+}
 
-	default:
-		log.Fatalf("unknown cache command: %s", args[0])
+// npmSystemDir holds the modules of distro-packaged npm and node tools, which the OS
+// package manager already reports
+const npmSystemDir = "usr/lib/node_modules"
+
+// isNodeModulesPath reports whether p is inside a node_modules directory
+func isNodeModulesPath(p string) bool {
+	return strings.HasPrefix(p, "node_modules/") || strings.Contains(p, "/node_modules/")
+}
+
+// npmPackageDirs returns the package directories (node_modules/name or
+// node_modules/@scope/name) that p is below, innermost first
+func npmPackageDirs(p string) []string {
+	parts := strings.Split(p, "/")
+	var dirs []string
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] != "node_modules" || strings.HasPrefix(parts[i+1], ".") {
+			continue // .bin, .package-lock.json and other npm bookkeeping
+		}
+		name := i + 1
+		if strings.HasPrefix(parts[name], "@") {
+			name++
+		}
+		if name >= len(parts)-1 {
+			break
+		}
+		dirs = append(dirs, strings.Join(parts[:name+1], "/"))
 	}
+	slices.Reverse(dirs)
+	return dirs
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
+// isNpmManifestPath reports whether p is the package.json of a package in node_modules
+func isNpmManifestPath(p string) bool {
+	if path.Base(p) != "package.json" {
+		return false
 	}
+	dirs := npmPackageDirs(p)
+	return len(dirs) > 0 && dirs[0] == path.Dir(p)
+}
 
-	// Handle --version and --help flags
-	for _, arg := range os.Args[1:] {
-		if arg == "--version" || arg == "-v" {
-			fmt.Printf("pkgpulse version %s\n", version)
-			os.Exit(0)
+// npmPackages returns one package per name found in node_modules, hoisted or nested, in
+// path order; copies installed at several paths are merged. Every file below
+// node_modules counts towards the innermost package holding it, so a package's size
+// excludes the nested packages it depends on.
+func (u *unionFS) npmPackages() []pkg {
+	manifests := make(map[string]*spooledFile) // package dir -> package.json
+	for p, f := range u.files {
+		if f.content != nil && isNpmManifestPath(p) && !strings.HasPrefix(p, npmSystemDir+"/") {
+			manifests[path.Dir(p)] = f.content
 		}
-		if arg == "--help" || arg == "-h" {
-			printUsage()
-			os.Exit(0)
+	}
+	sizes := make(map[string]int64, len(manifests))
+	for p, f := range u.files {
+		if f.link != "" || !isNodeModulesPath(p) {
+			continue
+		}
+		for _, dir := range npmPackageDirs(p) {
+			if _, ok := manifests[dir]; ok {
+				sizes[dir] += f.size
+				break
+			}
 		}
 	}
+	dirs := make([]string, 0, len(manifests))
+	for dir := range manifests {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
 
-	// Handle cache subcommands
-	if os.Args[1] == "cache" {
-		handleCacheCommand(os.Args[2:])
-		return
+	var packages []pkg
+	for _, dir := range dirs {
+		p, ok := parsePackageJSON(manifests[dir].reader())
+		if !ok {
+			continue
+		}
+		p.SizeKB = sizes[dir] / 1024
+		packages = append(packages, p)
+	}
+	return mergePackageCopies(packages)
+}
+
+// parsePackageJSON reads the name, version and license of an installed npm package
+func parsePackageJSON(r io.Reader) (pkg, bool) {
+	var manifest struct {
+		Name     string          `json:"name"`
+		Version  string          `json:"version"`
+		License  json.RawMessage `json:"license"`
+		Licenses []struct {
+			Type string `json:"type"`
+		} `json:"licenses"` // deprecated form
 	}
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return pkg{}, false
+	}
+	p := pkg{Name: manifest.Name, Version: manifest.Version, Type: langNPM}
 
-	var images []string
-	var csvOut string
-	var useSyft bool
-	var noCache bool
-	for i := 1; i < len(os.Args); i++ {
-		arg := os.Args[i]
-		switch arg {
-		case "--csv":
-			if i+1 < len(os.Args) {
-				csvOut = os.Args[i+1]
-				i++ // skip next arg
+	// license is an SPDX expression, or in old packages a {"type": ...} object
+	var license struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(manifest.License, &p.License); err != nil {
+		if err := json.Unmarshal(manifest.License, &license); err == nil {
+			p.License = license.Type
+		}
+	}
+	if p.License == "" {
+		var types []string
+		for _, l := range manifest.Licenses {
+			if l.Type != "" {
+				types = append(types, l.Type)
+			}
+		}
+		p.License = strings.Join(types, " OR ")
+	}
+	return p, p.Name != "" && p.Version != ""
+}
+
+// Archives nested deeper than this (a jar in a war in an ear is 2) are counted towards
+// their parent instead of being opened
+const maxJavaArchiveDepth = 2
+
+// javaSystemDirs hold distro-packaged Java libraries and JDKs, which the OS package
+// manager already reports
+var javaSystemDirs = []string{"usr/share/java", "usr/lib/jvm"}
+
+// isJavaArchivePath reports whether p names a Java archive
+func isJavaArchivePath(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".jar", ".war", ".ear":
+		return true
+	}
+	return false
+}
+
+// isJavaSystemPath reports whether p is in one of the javaSystemDirs
+func isJavaSystemPath(p string) bool {
+	return slices.ContainsFunc(javaSystemDirs, func(dir string) bool { return strings.HasPrefix(p, dir+"/") })
+}
+
+// javaPackages returns the packages of every Java archive in the final filesystem, in
+// path order, with copies of an artifact in several places merged; lazily read archives
+// are fetched and cataloged now
+func (u *unionFS) javaPackages() []pkg {
+	paths := make([]string, 0, len(u.files))
+	for p, f := range u.files {
+		if f.javaArchive {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var packages []pkg
+	for _, p := range paths {
+		f := u.files[p]
+		if f.lazy != nil {
+			content, err := spool(f.lazy, f.size)
+			if err != nil {
+				continue
+			}
+			f.java = catalogJavaArchive(p, content, f.size, f.size, 0)
+			_ = content.Close()
+		}
+		packages = append(packages, f.java...)
+	}
+	return mergePackageCopies(packages)
+}
+
+// catalogJavaArchive returns a package for the archive at p followed by the archives
+// nested in it (fat jars, WEB-INF/lib, ear modules). onDisk is the space the archive
+// takes in its parent; nested archives report theirs and are subtracted from the parent.
+// Files that aren't zip archives give nothing.
+func catalogJavaArchive(p string, r io.ReaderAt, size, onDisk int64, depth int) []pkg {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil
+	}
+
+	var manifest map[string]string
+	var poms []map[string]string
+	var nested []pkg
+	for _, f := range zr.File {
+		switch {
+		case f.Name == "META-INF/MANIFEST.MF":
+			if rc, err := f.Open(); err == nil {
+				manifest = parseJavaManifest(io.LimitReader(rc, 1<<20))
+				_ = rc.Close()
+			}
+		case strings.HasPrefix(f.Name, "META-INF/maven/") && path.Base(f.Name) == "pom.properties":
+			if rc, err := f.Open(); err == nil {
+				poms = append(poms, parseJavaProperties(io.LimitReader(rc, 1<<20)))
+				_ = rc.Close()
+			}
+		case depth < maxJavaArchiveDepth && isJavaArchivePath(f.Name) && !f.FileInfo().IsDir():
+			// The declared size is untrusted; an archive claiming more than the memory cap
+			// stays part of its parent rather than being buffered
+			if f.UncompressedSize64 > uint64(fileMemory.max()) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				continue
+			}
+			content, err := spool(rc, int64(f.UncompressedSize64))
+			_ = rc.Close()
+			if err != nil {
+				continue
+			}
+			if pkgs := catalogJavaArchive(f.Name, content, content.size, int64(f.CompressedSize64), depth+1); len(pkgs) > 0 {
+				onDisk -= int64(f.CompressedSize64)
+				nested = append(nested, pkgs...)
+			}
+			_ = content.Close()
+		}
+	}
+
+	archive := javaArchivePackage(p, poms, manifest)
+	archive.SizeKB = max(onDisk, 0) / 1024
+	return append([]pkg{archive}, nested...)
+}
+
+// javaArchivePackage identifies an archive by its Maven coordinates (group:artifact and
+// version from pom.properties), else its manifest, else its file name (name-1.2.3.jar)
+func javaArchivePackage(p string, poms []map[string]string, manifest map[string]string) pkg {
+	base := strings.TrimSuffix(path.Base(p), path.Ext(p))
+	fileName, fileVersion := base, ""
+	for i := 1; i+1 < len(base); i++ {
+		if base[i] == '-' && isDigit(base[i+1]) {
+			fileName, fileVersion = base[:i], base[i+1:]
+			break
+		}
+	}
+	archive := pkg{Name: fileName, Version: fileVersion, Type: langJava}
+
+	// Shaded jars carry the pom.properties of everything bundled; the archive's own
+	// artifact is the one its file is named after
+	var pom map[string]string
+	for _, candidate := range poms {
+		id := candidate["artifactId"]
+		if len(poms) == 1 || id == fileName || id == base {
+			pom = candidate
+			break
+		}
+	}
+	if pom != nil && pom["artifactId"] != "" {
+		archive.Name = pom["artifactId"]
+		if group := pom["groupId"]; group != "" {
+			archive.Name = group + ":" + archive.Name
+		}
+		archive.Version = cmp.Or(pom["version"], archive.Version)
+	} else if manifest != nil {
+		// Bundle-SymbolicName: org.example.lib;singleton:=true
+		symbolicName, _, _ := strings.Cut(manifest["Bundle-SymbolicName"], ";")
+		archive.Name = cmp.Or(strings.TrimSpace(symbolicName), archive.Name)
+		archive.Version = cmp.Or(manifest["Implementation-Version"], manifest["Bundle-Version"], archive.Version)
+	}
+	if license := manifest["Bundle-License"]; !strings.Contains(license, "://") {
+		archive.License = license
+	}
+	return archive
+}
+
+// parseJavaManifest reads the main section of a MANIFEST.MF, joining continuation lines
+func parseJavaManifest(r io.Reader) map[string]string {
+	attrs := make(map[string]string)
+	var key string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			return attrs // per-entry sections follow
+		case line[0] == ' ':
+			if key != "" {
+				attrs[key] += line[1:]
+			}
+		default:
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				key = ""
+				continue
+			}
+			key = strings.TrimSpace(k)
+			attrs[key] = strings.TrimSpace(v)
+		}
+	}
+	return attrs
+}
+
+// parseJavaProperties reads key=value lines of a .properties file, skipping comments
+func parseJavaProperties(r io.Reader) map[string]string {
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			props[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return props
+}
+
+// runSyftAndParse runs syft and parses output (fallback mode)
+func runSyftAndParse(ctx context.Context, image, platform string) ([]pkg, error) {
+	args := []string{image,
+		"--scope", "squashed",
+		"--select-catalogers", defaultCatalogers,
+		"-o", "syft-json"}
+	if platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	cmd := exec.CommandContext(ctx, "syft", args...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("required binary not found: %w", err)
+		}
+		return nil, fmt.Errorf("syft failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var sbom syftSBOM
+	if err := json.Unmarshal(out.Bytes(), &sbom); err != nil {
+		return nil, fmt.Errorf("parse syft-json: %w", err)
+	}
+
+	// Build file lookup map for binary packages
+	fileMap := make(map[string]int64)
+	for _, f := range sbom.Files {
+		if f.Metadata.Size > 0 {
+			fileMap[f.ID] = f.Metadata.Size
+		}
+	}
+
+	artifactToFile := make(map[string]string)
+	for _, rel := range sbom.ArtifactRelationships {
+		if rel.Type == "evident-by" {
+			artifactToFile[rel.Parent] = rel.Child
+		}
+	}
+
+	var packages []pkg
+	for _, a := range sbom.Artifacts {
+		var sizeKB int64
+		switch a.Type {
+		case "apk":
+			if a.Metadata.InstalledSize > 0 {
+				sizeKB = a.Metadata.InstalledSize / 1024
+			} else if a.Metadata.Size > 0 {
+				sizeKB = a.Metadata.Size / 1024
+			}
+		case "rpm":
+			if a.Metadata.Size > 0 {
+				sizeKB = a.Metadata.Size / 1024
+			}
+		case "deb":
+			if a.Metadata.InstalledSize > 0 {
+				sizeKB = a.Metadata.InstalledSize
+			}
+		case "alpm":
+			// Reported as "pacman", like the native parser, so runs with and without syft compare
+			a.Type = "pacman"
+			if a.Metadata.Size > 0 {
+				sizeKB = a.Metadata.Size / 1024
+			}
+		case "binary":
+			if fileID, ok := artifactToFile[a.ID]; ok {
+				if fileSize, ok := fileMap[fileID]; ok {
+					sizeKB = fileSize / 1024
+				}
 			}
-		case "--use-syft":
-			useSyft = true
-		case "--no-cache":
-			noCache = true
-		case "--version", "-v", "--help", "-h":
-			// Already handled above
 		default:
-			images = append(images, arg)
+			if a.Metadata.InstalledSize > 0 {
+				sizeKB = a.Metadata.InstalledSize
+			} else if a.Metadata.Size > 0 {
+				sizeKB = a.Metadata.Size / 1024
+			}
+		}
+
+		if sizeKB > 0 {
+			packages = append(packages, pkg{
+				Name:    a.Name,
+				Version: a.Version,
+				SizeKB:  sizeKB,
+				Type:    a.Type,
+			})
+		}
+	}
+
+	return packages, nil
+}
+
+func displayImageBreakdown(w io.Writer, result imageResult) {
+	fmt.Fprintf(w, "Image: %s\n", imageLabel(result.Image, result.Platform))
+	if result.Err != nil {
+		fmt.Fprintf(w, "Status: FAILED - %v\n\n", result.Err)
+		return
+	}
+	fmt.Fprintf(w, "Source: %s\n", result.Source)
+	if result.CompressedMB > 0 {
+		fmt.Fprintf(w, "Compressed size (pull): %.2f MB\n", result.CompressedMB)
+	} else {
+		fmt.Fprintf(w, "Compressed size (pull): N/A (local image)\n")
+	}
+	if result.ManifestOnly {
+		fmt.Fprintf(w, "Layers: %d\n", result.LayerCount)
+		fmt.Fprintf(w, "Created: %s\n", formatCreated(result.Created))
+		fmt.Fprintf(w, "Architecture: %s\n", orDash(result.Architecture))
+		fmt.Fprintf(w, "Packages: not analyzed (--manifest-only)\n\n")
+		return
+	}
+	fmt.Fprintf(w, "Installed size (on disk): %.2f MB\n", result.InstalledMB)
+	fmt.Fprintf(w, "Packages: %d\n\n", result.PackageCount)
+
+	fmt.Fprintln(w, "Packages by installed size (on-disk MB):")
+	for _, r := range result.Rows {
+		fmt.Fprintf(w, "  %-40s %-20s %8.2f MB\n", trunc(r.Name, 40), trunc(r.Ver, 20), r.MB)
+	}
+	fmt.Fprintln(w)
+}
+
+func displayComparisonTable(w io.Writer, results []imageResult) {
+	keys, cells := buildComparisonMatrix(results)
+
+	// Summary comparison
+	fmt.Fprintln(w, "Summary Comparison:")
+	fmt.Fprintf(w, "%-50s %14s %15s %15s %10s\n", "Image", "Source", "Compressed", "Installed", "Packages")
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("-"), 108)))
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%-50s %14s   %s\n", trunc(imageLabel(r.Image, r.Platform), 50), "FAILED", trunc(r.Err.Error(), 60))
+			continue
+		}
+		compressedStr := fmt.Sprintf("%.2f MB", r.CompressedMB)
+		if r.CompressedMB == 0 {
+			compressedStr = "N/A"
+		}
+		fmt.Fprintf(w, "%-50s %14s %15s %15s %10d\n",
+			trunc(imageLabel(r.Image, r.Platform), 50), r.Source, compressedStr,
+			fmt.Sprintf("%.2f MB", r.InstalledMB), r.PackageCount)
+	}
+	fmt.Fprintln(w)
+
+	// Build header
+	fmt.Fprintln(w, "Package Version & Size Comparison:")
+	header := fmt.Sprintf("%-40s", "Package")
+	for i := range results {
+		header += fmt.Sprintf(" | %-18s %8s", fmt.Sprintf("Image %d Ver", i+1), "MB")
+	}
+	fmt.Fprintln(w, header)
+	sepWidth := 40 + len(results)*30
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("-"), sepWidth)))
+
+	// Display packages
+	anyNewest := false
+	for _, key := range keys {
+		line := fmt.Sprintf("%-40s", trunc(key.String(), 40))
+		for _, cell := range cells[key] {
+			if cell.Present {
+				marker := " "
+				if cell.Newest {
+					marker = "*"
+					anyNewest = true
+				}
+				line += fmt.Sprintf(" | %-17s%s %8.2f", trunc(cell.Version, 17), marker, cell.MB)
+			} else {
+				line += fmt.Sprintf(" | %-18s %8s", "-", "-")
+			}
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	if anyNewest {
+		fmt.Fprintln(w, "\n* newest version among images that ship the package")
+	}
+	fmt.Fprintln(w)
+	for i, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "Image %d: %s (FAILED)\n", i+1, imageLabel(r.Image, r.Platform))
+			continue
 		}
+		fmt.Fprintf(w, "Image %d: %s\n", i+1, imageLabel(r.Image, r.Platform))
 	}
+}
 
-	if len(images) == 0 {
-		log.Fatalf("no images specified")
+// isManifestOnly reports whether results come from a --manifest-only run
+func isManifestOnly(results []imageResult) bool {
+	for _, r := range results {
+		if r.ManifestOnly {
+			return true
+		}
 	}
+	return false
+}
 
-	// Analyze images in parallel with bounded concurrency
-	results := make([]imageResult, len(images))
-	var wg sync.WaitGroup
-
-	// Semaphore to limit concurrent goroutines
-	sem := make(chan struct{}, defaultConcurrency)
+func formatCreated(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format("2006-01-02 15:04")
+}
 
-	// Channel for single-line progress renderer
-	progressChan := make(chan progressEvent, 256)
-	doneChan := make(chan struct{})
-	go runProgressRenderer(progressChan, len(images), doneChan)
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
 
-	// Build mode description for output
-	modeStr := ""
-	if noCache {
-		modeStr = " (no cache)"
+// displayManifestTable is the --manifest-only summary: pull size and config details, no packages
+func displayManifestTable(w io.Writer, results []imageResult) {
+	fmt.Fprintln(w, "Summary Comparison (manifest only):")
+	fmt.Fprintf(w, "%-50s %14s %15s %7s %17s %-14s\n", "Image", "Source", "Compressed", "Layers", "Created", "Architecture")
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("-"), 122)))
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%-50s %14s   %s\n", trunc(imageLabel(r.Image, r.Platform), 50), "FAILED", trunc(r.Err.Error(), 60))
+			continue
+		}
+		compressedStr := fmt.Sprintf("%.2f MB", r.CompressedMB)
+		if r.CompressedMB == 0 {
+			compressedStr = "N/A"
+		}
+		fmt.Fprintf(w, "%-50s %14s %15s %7d %17s %-14s\n",
+			trunc(imageLabel(r.Image, r.Platform), 50), r.Source, compressedStr,
+			r.LayerCount, formatCreated(r.Created), orDash(r.Architecture))
 	}
-	if useSyft {
-		modeStr += " (using syft)"
+}
+
+func buildComparisonMatrix(results []imageResult) ([]packageKey, map[packageKey][]comparisonCell) {
+	allPackages := make(map[packageKey]bool)
+	for _, result := range results {
+		for key := range result.PackageMap {
+			allPackages[key] = true
+		}
 	}
 
-	if len(images) > 1 {
-		fmt.Fprintf(os.Stderr, "Analyzing %d images in parallel%s...\n", len(images), modeStr)
-	} else if modeStr != "" {
-		fmt.Fprintf(os.Stderr, "Analyzing%s...\n", modeStr)
+	keys := make([]packageKey, 0, len(allPackages))
+	for key := range allPackages {
+		keys = append(keys, key)
 	}
+	slices.SortFunc(keys, comparePackageKeys)
 
-	for i, image := range images {
-		wg.Add(1)
-		go func(idx int, img string) {
-			defer wg.Done()
-			sem <- struct{}{}        // Acquire semaphore
-			defer func() { <-sem }() // Release semaphore
-			send := func(ev progressEvent) {
-				progressChan <- ev
+	cells := make(map[packageKey][]comparisonCell, len(keys))
+	for _, key := range keys {
+		rowCells := make([]comparisonCell, len(results))
+		for i, result := range results {
+			if r, found := result.PackageMap[key]; found {
+				rowCells[i] = comparisonCell{
+					Version: r.Ver,
+					MB:      r.MB,
+					Type:    r.Type,
+					Present: true,
+				}
 			}
-			result := analyzeImage(img, idx, len(images), send, useSyft, noCache)
-			results[idx] = result
-		}(i, image)
+		}
+		markNewestVersions(rowCells)
+		cells[key] = rowCells
 	}
 
-	wg.Wait()
-	close(progressChan)
-	<-doneChan
+	return keys, cells
+}
 
-	// Print completion summary
-	for i, img := range images {
-		fmt.Fprintf(os.Stderr, "[%d/%d] ✓ %s\n", i+1, len(images), img)
+// markNewestVersions flags the cells holding the newest version when a package
+// is present in several images with differing versions.
+func markNewestVersions(rowCells []comparisonCell) {
+	newest := -1
+	differs := false
+	for i, cell := range rowCells {
+		if !cell.Present {
+			continue
+		}
+		if newest == -1 {
+			newest = i
+			continue
+		}
+		c := comparePackageVersions(cell.Type, cell.Version, rowCells[newest].Type, rowCells[newest].Version)
+		if c != 0 {
+			differs = true
+		}
+		if c > 0 {
+			newest = i
+		}
 	}
+	if !differs {
+		return
+	}
+	best := rowCells[newest]
+	for i, cell := range rowCells {
+		if cell.Present && comparePackageVersions(cell.Type, cell.Version, best.Type, best.Version) == 0 {
+			rowCells[i].Newest = true
+		}
+	}
+}
 
-	// Display results
-	fmt.Fprintf(os.Stderr, "\n")
-	fmt.Println(string(bytes.Repeat([]byte("="), 80)))
+/* ---- JSON output ---- */
 
-	if len(results) > 1 {
-		// Multiple images: only show comparison table (skip individual breakdowns)
-		fmt.Println("COMPARISON")
-		fmt.Println(string(bytes.Repeat([]byte("="), 80)) + "\n")
-		displayComparisonTable(results)
-	} else {
-		// Single image: show detailed breakdown
-		fmt.Println("RESULTS")
-		fmt.Println(string(bytes.Repeat([]byte("="), 80)) + "\n")
-		displayImageBreakdown(results[0])
+func buildJSONReport(results []imageResult) jsonReport {
+	report := jsonReport{
+		SchemaVersion: jsonSchemaVersion,
+		Report:        "analysis",
+		Tool:          "pkgpulse",
+		ToolVersion:   version,
+		GeneratedAt:   time.Now().UTC(),
+		Images:        make([]jsonImage, 0, len(results)),
 	}
 
-	csvPath := csvOut
-	autoCSV := false
-	if csvPath == "" && len(results) > 3 {
-		csvPath = "pkgpulse.csv"
-		autoCSV = true
+	for _, r := range results {
+		report.Images = append(report.Images, toJSONImage(r))
 	}
 
-	if csvPath != "" {
-		if len(results) > 1 {
-			if err := writeComparisonCSV(csvPath, results); err != nil {
-				log.Fatalf("write comparison CSV: %v", err)
-			}
-			if autoCSV {
-				fmt.Printf("\nWrote CSV automatically: %s (summary + comparison table)\n", csvPath)
-			} else {
-				fmt.Printf("\nWrote CSV: %s (summary + comparison table)\n", csvPath)
-			}
-		} else {
-			if err := writePackageCSV(csvPath, results[0].Rows); err != nil {
-				log.Fatalf("write CSV: %v", err)
+	if len(results) > 1 {
+		keys, cells := buildComparisonMatrix(results)
+		comparison := &jsonComparison{
+			Images:   make([]string, 0, len(results)),
+			Packages: make([]jsonComparisonRow, 0, len(keys)),
+		}
+		for _, r := range results {
+			comparison.Images = append(comparison.Images, imageLabel(r.Image, r.Platform))
+		}
+		for _, key := range keys {
+			out := jsonComparisonRow{Name: key.Name, Cells: make([]jsonComparisonCell, 0, len(results))}
+			for _, cell := range cells[key] {
+				out.Cells = append(out.Cells, jsonComparisonCell{
+					Present:     cell.Present,
+					Type:        cell.Type,
+					Version:     cell.Version,
+					InstalledMB: cell.MB,
+					Newest:      cell.Newest,
+				})
 			}
-			fmt.Printf("\nWrote CSV: %s (package,version,installed_MB)\n", csvPath)
+			comparison.Packages = append(comparison.Packages, out)
 		}
+		report.Comparison = comparison
 	}
+
+	return report
 }
 
-func analyzeImage(image string, idx, total int, sendProgress func(progressEvent), useSyft bool, noCache bool) imageResult {
-	emit := func(stage, message string, current, totalSize int64, rateBps float64, done bool) {
-		sendProgress(progressEvent{
-			idx:       idx,
-			total:     total,
-			image:     image,
-			stage:     stage,
-			message:   message,
-			current:   current,
-			totalSize: totalSize,
-			rateBps:   rateBps,
-			done:      done,
+func toJSONImage(r imageResult) jsonImage {
+	img := jsonImage{
+		Image:        r.Image,
+		Platform:     r.Platform,
+		Digest:       r.Digest,
+		Source:       r.Source,
+		CompressedMB: r.CompressedMB,
+		InstalledMB:  r.InstalledMB,
+		PackageCount: r.PackageCount,
+		Packages:     make([]jsonPackage, 0, len(r.Rows)),
+	}
+	if r.Err != nil {
+		img.Error = r.Err.Error()
+	}
+	if r.ManifestOnly {
+		img.ManifestOnly = true
+		img.LayerCount = r.LayerCount
+		img.Architecture = r.Architecture
+		if !r.Created.IsZero() {
+			created := r.Created.UTC()
+			img.Created = &created
+		}
+	}
+	for _, row := range r.Rows {
+		img.Packages = append(img.Packages, jsonPackage{
+			Name:        row.Name,
+			Version:     row.Ver,
+			Type:        row.Type,
+			InstalledKB: row.SizeKB,
+			InstalledMB: row.MB,
+			Arch:        row.Arch,
+			License:     row.License,
+			Versions:    row.Vers,
 		})
 	}
+	return img
+}
 
-	// Parse image reference
-	emit("resolving", "parsing image reference", 0, 0, 0, false)
-	ref, err := name.ParseReference(image)
-	check(err)
+// writeJSONReport encodes the analysis report; eval is nil when no policy was given
+func writeJSONReport(w io.Writer, results []imageResult, eval *policyEvaluation) error {
+	report := buildJSONReport(results)
+	if eval != nil {
+		report.Policy = buildPolicyJSON(*eval)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
 
-	var img v1.Image
-	var totalCompressed int64
-	var sourceRemote bool
-	source := "cache"
+/* ---- Policy ---- */
 
-	var downloadedBytes atomic.Int64
-	var estimatedTotalBytes atomic.Int64
-	stopDownloadProgress := make(chan struct{})
-	downloadProgressStopped := make(chan struct{})
-	var stopDownloadOnce sync.Once
+// loadPolicy reads a policy from a .json file, or YAML otherwise. Unknown keys are
+// rejected so a misspelled rule can't silently pass every image.
+func loadPolicy(policyPath string) (*policy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, err
+	}
 
-	go func() {
-		ticker := time.NewTicker(200 * time.Millisecond)
-		defer ticker.Stop()
-		defer close(downloadProgressStopped)
-		lastBytes := int64(0)
-		lastTick := time.Now()
-		for {
-			select {
-			case <-stopDownloadProgress:
-				return
-			case <-ticker.C:
-				current := downloadedBytes.Load()
-				now := time.Now()
-				delta := current - lastBytes
-				rate := 0.0
-				if dt := now.Sub(lastTick).Seconds(); dt > 0 {
-					rate = float64(delta) / dt
-				}
-				lastBytes = current
-				lastTick = now
-				if current > 0 {
-					emit("downloading", "pulling image bytes", current, estimatedTotalBytes.Load(), rate, false)
-				}
-			}
-		}
-	}()
-	stopDownload := func() {
-		stopDownloadOnce.Do(func() {
-			close(stopDownloadProgress)
-			<-downloadProgressStopped
-		})
+	var p policy
+	if strings.EqualFold(filepath.Ext(policyPath), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&p)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&p)
+	}
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: policy file is empty", policyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", policyPath, err)
 	}
-	defer stopDownload()
 
-	// Try cache first (unless --no-cache or --use-syft)
-	if !noCache && !useSyft {
-		emit("cache_load", "checking local cache", 0, 0, 0, false)
-		if cachedImg, _, ok := loadFromCache(image, func(msg string) {
-			emit("cache_load", msg, 0, 0, 0, false)
-		}); ok {
-			img = cachedImg
+	if p.MaxCompressedMB != nil && *p.MaxCompressedMB < 0 {
+		return nil, fmt.Errorf("%s: max_compressed_mb must not be negative", policyPath)
+	}
+	if p.MaxInstalledMB != nil && *p.MaxInstalledMB < 0 {
+		return nil, fmt.Errorf("%s: max_installed_mb must not be negative", policyPath)
+	}
+	if p.MaxPackages != nil && *p.MaxPackages < 0 {
+		return nil, fmt.Errorf("%s: max_packages must not be negative", policyPath)
+	}
+	for _, pattern := range append(append([]string{}, p.ForbiddenPackages...), p.RequiredPackages...) {
+		if pattern == "" {
+			return nil, fmt.Errorf("%s: empty package name", policyPath)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid package pattern %q", policyPath, pattern)
 		}
 	}
+	for pattern, minVersion := range p.MinVersions {
+		if pattern == "" {
+			return nil, fmt.Errorf("%s: empty package name", policyPath)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid package pattern %q", policyPath, pattern)
+		}
+		if minVersion == "" {
+			return nil, fmt.Errorf("%s: min_versions: empty version for %s", policyPath, pattern)
+		}
+	}
+	if p.MaxCompressedMB == nil && p.MaxInstalledMB == nil && p.MaxPackages == nil &&
+		len(p.ForbiddenPackages) == 0 && len(p.RequiredPackages) == 0 && len(p.MinVersions) == 0 {
+		return nil, fmt.Errorf("%s: policy defines no rules", policyPath)
+	}
+	return &p, nil
+}
 
-	// Fetch from registry if not in cache
-	if img == nil {
-		sourceRemote = true
-		emit("manifest", "fetching from registry", 0, 0, 0, false)
-		transport := &progressTransport{
-			base: http.DefaultTransport,
-			onBytes: func(n int64) {
-				downloadedBytes.Add(n)
-			},
-		}
-		opts := []remote.Option{
-			remote.WithAuthFromKeychain(authn.DefaultKeychain),
-			remote.WithTransport(transport),
-		}
-		remoteImg, remoteErr := remote.Image(ref, opts...)
-		check(remoteErr)
-		source = "remote"
+// evaluatePolicy checks every successfully analyzed image against the policy.
+// Failed images are left out; they already fail the run.
+func evaluatePolicy(p policy, results []imageResult) []policyResult {
+	minVersionPatterns := make([]string, 0, len(p.MinVersions))
+	for pattern := range p.MinVersions {
+		minVersionPatterns = append(minVersionPatterns, pattern)
+	}
+	sort.Strings(minVersionPatterns)
 
-		// Get compressed size from manifest
-		manifest, err := remoteImg.Manifest()
-		check(err)
-		totalCompressed += manifest.Config.Size
-		for _, l := range manifest.Layers {
-			totalCompressed += l.Size
+	var out []policyResult
+	for _, r := range results {
+		if r.Err != nil {
+			continue
+		}
+		res := policyResult{Image: r.Image, Platform: r.Platform}
+		violate := func(rule, format string, args ...any) {
+			res.Violations = append(res.Violations, policyViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
 		}
-		estimatedTotalBytes.Store(totalCompressed)
-		emit("downloading", "pulling image bytes", downloadedBytes.Load(), totalCompressed, 0, false)
 
-		// Save to cache and reload for consistent fast analysis
-		if !noCache && !useSyft {
-			emit("cache_save", "writing cache tarball", 0, 0, 0, false)
-			if err := saveToCache(image, remoteImg, func(msg string) {
-				emit("cache_save", msg, 0, 0, 0, false)
-			}); err != nil {
-				emit("cache_save", fmt.Sprintf("cache save failed: %v", err), 0, 0, 0, false)
-				img = remoteImg // Fall back to remote image if cache fails
-			} else {
-				// Reload from cache for fast parallel analysis
-				emit("cache_reload", "reloading from cache", 0, 0, 0, false)
-				if cachedImg, _, ok := loadFromCache(image, func(msg string) {
-					emit("cache_reload", msg, 0, 0, 0, false)
-				}); ok {
-					img = cachedImg
-					source = "cached"
-					sourceRemote = false
-				} else {
-					img = remoteImg
+		if p.MaxCompressedMB != nil {
+			switch {
+			case r.CompressedMB == 0:
+				res.Skipped = append(res.Skipped, "max_compressed_mb: compressed size unknown for this source")
+			case r.CompressedMB > *p.MaxCompressedMB:
+				violate("max_compressed_mb", "compressed size %.2f MB exceeds %.2f MB", r.CompressedMB, *p.MaxCompressedMB)
+			}
+		}
+		if p.MaxInstalledMB != nil && r.InstalledMB > *p.MaxInstalledMB {
+			violate("max_installed_mb", "installed size %.2f MB exceeds %.2f MB", r.InstalledMB, *p.MaxInstalledMB)
+		}
+		if p.MaxPackages != nil && r.PackageCount > *p.MaxPackages {
+			violate("max_packages", "%d packages exceeds %d", r.PackageCount, *p.MaxPackages)
+		}
+		// Package rules see every parsed package, including empty meta-packages
+		for _, pattern := range p.ForbiddenPackages {
+			for _, row := range r.AllRows {
+				if matchPackagePattern(pattern, row.Name) {
+					violate("forbidden_packages", "%s %s is installed", row.Name, row.Ver)
+				}
+			}
+		}
+		for _, pattern := range p.RequiredPackages {
+			found := false
+			for _, row := range r.AllRows {
+				if matchPackagePattern(pattern, row.Name) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				violate("required_packages", "%s is not installed", pattern)
+			}
+		}
+		// Every copy of a package installed at several versions must be new enough
+		for _, pattern := range minVersionPatterns {
+			minVersion := p.MinVersions[pattern]
+			for _, row := range r.AllRows {
+				if !matchPackagePattern(pattern, row.Name) {
+					continue
+				}
+				versions := row.Vers
+				if len(versions) == 0 {
+					versions = []string{row.Ver}
+				}
+				for _, v := range versions {
+					if comparePackageVersions(row.Type, v, row.Type, minVersion) < 0 {
+						violate("min_versions", "%s %s is older than %s", row.Name, v, minVersion)
+					}
 				}
 			}
-		} else {
-			img = remoteImg
 		}
+		out = append(out, res)
 	}
+	return out
+}
 
-	var packages []pkg
+// matchPackagePattern matches a package name against an exact name or glob such as "python3*"
+func matchPackagePattern(pattern, name string) bool {
+	ok, _ := path.Match(pattern, name) // patterns are validated in loadPolicy
+	return ok
+}
 
-	if useSyft {
-		// Fallback to syft
-		stopDownload()
-		emit("syft", "running syft scan", 0, 0, 0, false)
-		packages = runSyftAndParse(image)
-	} else {
-		// Native parsing
-		emit("parsing", "extracting package databases", 0, 0, 0, false)
-		packages = extractPackagesFromImage(img, func(message string, currentLayer, totalLayers int64) {
-			emit("parsing", message, currentLayer, totalLayers, 0, false)
-		})
-		if sourceRemote {
-			stopDownload()
+func (e policyEvaluation) violatingImages() int {
+	n := 0
+	for _, r := range e.Results {
+		if len(r.Violations) > 0 {
+			n++
 		}
 	}
+	return n
+}
 
-	emit("processing", fmt.Sprintf("processing %d packages", len(packages)), int64(len(packages)), int64(len(packages)), 0, false)
+func displayPolicyReport(w io.Writer, e policyEvaluation) {
+	fmt.Fprintln(w, "\n"+string(bytes.Repeat([]byte("="), 80)))
+	fmt.Fprintf(w, "POLICY (%s)\n", e.Path)
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80))+"\n")
 
-	// Build output rows
-	rows := make([]row, 0, len(packages))
-	pkgMap := make(map[string]row)
-	var totalInstalled int64
+	if len(e.Results) == 0 {
+		fmt.Fprintln(w, "No images were analyzed successfully; nothing to check.")
+		return
+	}
 
-	for _, p := range packages {
-		if p.SizeKB > 0 {
-			totalInstalled += p.SizeKB
-			r := row{
-				Name: p.Name,
-				Ver:  p.Version,
-				MB:   float64(p.SizeKB) / 1024.0,
-			}
-			rows = append(rows, r)
-			pkgMap[p.Name] = r
+	for _, r := range e.Results {
+		label := imageLabel(r.Image, r.Platform)
+		if len(r.Violations) == 0 {
+			fmt.Fprintf(w, "✓ %s\n", label)
+		} else {
+			fmt.Fprintf(w, "✗ %s (%d violations)\n", label, len(r.Violations))
+		}
+		for _, v := range r.Violations {
+			fmt.Fprintf(w, "    %-20s %s\n", v.Rule, v.Message)
+		}
+		for _, s := range r.Skipped {
+			fmt.Fprintf(w, "    skipped %s\n", s)
 		}
 	}
 
-	sort.Slice(rows, func(i, j int) bool { return rows[i].MB > rows[j].MB })
-	emit("done", "completed", 0, 0, 0, true)
+	violating := e.violatingImages()
+	if violating == 0 {
+		fmt.Fprintf(w, "\nPolicy passed for all %d images\n", len(e.Results))
+	} else {
+		fmt.Fprintf(w, "\nPolicy failed: %d of %d images have violations\n", violating, len(e.Results))
+	}
+}
 
-	return imageResult{
-		Image:        image,
-		CompressedMB: toMB(totalCompressed),
-		InstalledMB:  float64(totalInstalled) / 1024.0,
-		PackageCount: len(rows),
-		Rows:         rows,
-		PackageMap:   pkgMap,
-		Source:       source,
+func buildPolicyJSON(e policyEvaluation) *jsonPolicy {
+	out := &jsonPolicy{
+		File:   e.Path,
+		Passed: e.violatingImages() == 0,
+		Images: make([]jsonPolicyImage, 0, len(e.Results)),
+	}
+	for _, r := range e.Results {
+		img := jsonPolicyImage{
+			Image:      r.Image,
+			Platform:   r.Platform,
+			Passed:     len(r.Violations) == 0,
+			Violations: make([]jsonPolicyViolation, 0, len(r.Violations)),
+			Skipped:    r.Skipped,
+		}
+		for _, v := range r.Violations {
+			img.Violations = append(img.Violations, jsonPolicyViolation{Rule: v.Rule, Message: v.Message})
+		}
+		out.Images = append(out.Images, img)
 	}
+	return out
 }
 
-// extractPackagesFromImage reads package databases from image layers
-func extractPackagesFromImage(img v1.Image, logProgress func(message string, currentLayer, totalLayers int64)) []pkg {
-	layers, err := img.Layers()
-	if err != nil {
-		log.Printf("Warning: could not get layers: %v", err)
-		return nil
+/* ---- Diff ---- */
+
+func handleDiffCommand(args []string) {
+	opts := parseRunFlags(args)
+	if len(opts.images) != 2 {
+		log.Fatalf("usage: pkgpulse diff [flags] <old-image> <new-image>")
+	}
+	if opts.allPlatforms {
+		log.Fatalf("--all-platforms is not supported by diff, use --platform")
+	}
+	if opts.policyPath != "" {
+		log.Fatalf("--policy is not supported by diff")
+	}
+	if opts.manifestOnly {
+		log.Fatalf("--manifest-only is not supported by diff")
+	}
+	if opts.baselinePath != "" || opts.tolerance != "" {
+		log.Fatalf("--baseline and --tolerance are only supported by check")
 	}
 
-	totalLayers := len(layers)
-	logProgress(fmt.Sprintf("scanning %d layers", totalLayers), 0, int64(totalLayers))
+	ctx, stop := interruptContext()
+	results := analyzeImages(ctx, buildImageJobs(ctx, opts), opts)
+	stop()
+	for _, r := range results {
+		if r.Err != nil {
+			log.Fatalf("%s: %v", imageLabel(r.Image, r.Platform), r.Err)
+		}
+	}
+	diff := buildImageDiff(results[0], results[1])
+
+	out, closeOut := openOutput(opts.outputPath)
+	notices := io.Writer(os.Stdout)
+	if opts.format == "json" {
+		notices = os.Stderr
+		if err := writeDiffJSON(out, diff); err != nil {
+			log.Fatalf("write JSON: %v", err)
+		}
+	} else {
+		displayImageDiff(out, diff)
+	}
+	closeOut()
+	if opts.outputPath != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %s diff: %s\n", opts.format, opts.outputPath)
+	}
 
-	// We want the final state, so read layers in order
-	// and keep only the last version of each database file
-	var apkData, dpkgData []byte
-	dpkgStatusParts := make(map[string][]byte)
-	dpkgFromStatusDir := false
-	var rpmData []byte
-	var rpmFormat string // "sqlite", "bdb", or "ndb"
+	if opts.csvOut != "" {
+		if err := writeDiffCSV(opts.csvOut, diff); err != nil {
+			log.Fatalf("write diff CSV: %v", err)
+		}
+		fmt.Fprintf(notices, "\nWrote CSV: %s (summary + changes)\n", opts.csvOut)
+	}
 
-	// Track potential Go binaries (executable files in common locations)
-	goBinaries := make(map[string]int64) // path -> size
+	if code := diffExitCode(diff, opts.failOnChange); code != 0 {
+		fmt.Fprintf(os.Stderr, "\n%d packages changed\n", len(diff.Changes))
+		os.Exit(code)
+	}
+}
 
-	for i, layer := range layers {
-		logProgress(fmt.Sprintf("layer %d/%d", i+1, totalLayers), int64(i+1), int64(totalLayers))
+// diffExitCode is the exit code of diff: exitDiffChanged when --fail-on-change is set
+// and any package changed, otherwise 0
+func diffExitCode(d imageDiff, failOnChange bool) int {
+	if failOnChange && len(d.Changes) > 0 {
+		return exitDiffChanged
+	}
+	return 0
+}
 
-		rc, err := layer.Uncompressed()
-		if err != nil {
+// buildImageDiff classifies every package of two results using the comparison matrix
+func buildImageDiff(oldResult, newResult imageResult) imageDiff {
+	diff := imageDiff{Old: oldResult, New: newResult}
+
+	keys, cells := buildComparisonMatrix([]imageResult{oldResult, newResult})
+	for _, key := range keys {
+		o, n := cells[key][0], cells[key][1]
+		change := packageChange{
+			Key:        key,
+			Type:       cmp.Or(n.Type, o.Type),
+			OldVersion: o.Version,
+			NewVersion: n.Version,
+			OldMB:      o.MB,
+			NewMB:      n.MB,
+		}
+		versionOrder := 0
+		if o.Present && n.Present {
+			versionOrder = comparePackageVersions(o.Type, o.Version, n.Type, n.Version)
+		}
+		switch {
+		case !o.Present:
+			change.Kind = changeAdded
+		case !n.Present:
+			change.Kind = changeRemoved
+		case versionOrder < 0:
+			change.Kind = changeUpgraded
+		case versionOrder > 0:
+			change.Kind = changeDowngraded
+		case o.MB != n.MB:
+			change.Kind = changeSizeChanged
+		default:
+			diff.Unchanged++
 			continue
 		}
+		diff.Changes = append(diff.Changes, change)
+	}
 
-		tr := tar.NewReader(rc)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				break
-			}
-
-			// Normalize path (remove leading /)
-			path := strings.TrimPrefix(hdr.Name, "/")
-			path = strings.TrimPrefix(path, "./")
-
-			// Track dpkg status.d fragments (used by distroless)
-			if strings.HasPrefix(path, dpkgStatusDir+"/") {
-				base := filepath.Base(path)
-				if target, found := strings.CutPrefix(base, ".wh."); found {
-					if base == ".wh..wh..opq" {
-						for k := range dpkgStatusParts {
-							delete(dpkgStatusParts, k)
-						}
-					} else {
-						delete(dpkgStatusParts, filepath.Join(dpkgStatusDir, target))
-					}
-					continue
-				}
-				if hdr.Typeflag == tar.TypeReg && !strings.HasSuffix(base, ".md5sums") {
-					data, _ := io.ReadAll(tr)
-					dpkgStatusParts[path] = data
-				}
-				continue
-			}
+	// Group by kind; names stay sorted within each group
+	rank := make(map[string]int, len(changeKindOrder))
+	for i, kind := range changeKindOrder {
+		rank[kind] = i
+	}
+	sort.SliceStable(diff.Changes, func(i, j int) bool {
+		return rank[diff.Changes[i].Kind] < rank[diff.Changes[j].Kind]
+	})
 
-			// Check for whiteout (deletion marker)
-			if whiteoutBase, found := strings.CutPrefix(filepath.Base(path), ".wh."); found {
-				removedPath := whiteoutBase
-				if dir := filepath.Dir(path); dir != "." {
-					removedPath = filepath.Join(dir, whiteoutBase)
-				}
+	return diff
+}
 
-				// This is a whiteout - file was deleted
-				switch removedPath {
-				case apkDBPath:
-					apkData = nil
-				case dpkgDBPath:
-					dpkgData = nil
-				case rpmDBPathSqlite:
-					rpmData = nil
-				case rpmDBPathBDB:
-					rpmData = nil
-				case rpmDBPathNDB:
-					rpmData = nil
-				}
-				// Also handle whiteout of binaries
-				delete(goBinaries, removedPath)
-				continue
-			}
+func (d imageDiff) countByKind() map[string]int {
+	counts := make(map[string]int, len(changeKindOrder))
+	for _, c := range d.Changes {
+		counts[c.Kind]++
+	}
+	return counts
+}
 
-			// Read package database files
-			switch path {
-			case apkDBPath:
-				data, _ := io.ReadAll(tr)
-				apkData = data
-			case dpkgDBPath:
-				data, _ := io.ReadAll(tr)
-				dpkgData = data
-			case rpmDBPathSqlite:
-				data, _ := io.ReadAll(tr)
-				rpmData = data
-				rpmFormat = "sqlite"
-			case rpmDBPathBDB:
-				data, _ := io.ReadAll(tr)
-				rpmData = data
-				rpmFormat = "bdb"
-			case rpmDBPathNDB:
-				data, _ := io.ReadAll(tr)
-				rpmData = data
-				rpmFormat = "ndb"
-			default:
-				// Check for potential Go binaries (executable files in bin directories)
-				if hdr.Typeflag == tar.TypeReg && hdr.Mode&0111 != 0 && hdr.Size > 0 {
-					dir := filepath.Dir(path)
-					if dir == "usr/bin" || dir == "usr/local/bin" || dir == "bin" || dir == "usr/sbin" || dir == "sbin" {
-						goBinaries[path] = hdr.Size
-					}
-				}
-			}
-		}
-		_ = rc.Close()
+// compressedDelta returns the pull size change, or false when either size is unknown
+func (d imageDiff) compressedDelta() (float64, bool) {
+	if d.Old.CompressedMB == 0 || d.New.CompressedMB == 0 {
+		return 0, false
 	}
+	return d.New.CompressedMB - d.Old.CompressedMB, true
+}
 
-	// Parse the databases we found
-	var packages []pkg
+/* ---- Snapshot baselines ---- */
 
-	if len(dpkgData) == 0 && len(dpkgStatusParts) > 0 {
-		logProgress(fmt.Sprintf("combining %d dpkg status.d entries", len(dpkgStatusParts)), int64(totalLayers), int64(totalLayers))
-		dpkgData = combineDpkgStatusParts(dpkgStatusParts)
-		dpkgFromStatusDir = true
+func handleSnapshotCommand(args []string) {
+	opts := parseRunFlags(args)
+	if len(opts.images) != 1 {
+		log.Fatalf("usage: pkgpulse snapshot [flags] <image> [-o file]")
 	}
-
-	if len(apkData) > 0 {
-		logProgress("parsing apk database", int64(totalLayers), int64(totalLayers))
-		pkgs := parseAPKDB(apkData)
-		packages = append(packages, pkgs...)
-		logProgress(fmt.Sprintf("found %d apk packages", len(pkgs)), int64(totalLayers), int64(totalLayers))
+	if opts.allPlatforms {
+		log.Fatalf("--all-platforms is not supported by snapshot, use --platform")
 	}
-	if len(dpkgData) > 0 {
-		logProgress("parsing dpkg database", int64(totalLayers), int64(totalLayers))
-		pkgs := parseDpkgDB(dpkgData, dpkgFromStatusDir)
-		packages = append(packages, pkgs...)
-		logProgress(fmt.Sprintf("found %d deb packages", len(pkgs)), int64(totalLayers), int64(totalLayers))
+	if err := checkSnapshotFlags(opts); err != nil {
+		log.Fatal(err)
 	}
-	if len(rpmData) > 0 {
-		logProgress(fmt.Sprintf("parsing rpm database (%s)", rpmFormat), int64(totalLayers), int64(totalLayers))
-		pkgs := parseRPMDB(rpmData, rpmFormat)
-		packages = append(packages, pkgs...)
-		logProgress(fmt.Sprintf("found %d rpm packages", len(pkgs)), int64(totalLayers), int64(totalLayers))
+	path := opts.outputPath
+	if path == "" {
+		path = defaultBaselinePath
 	}
 
-	// If no OS packages found, inspect executable binaries in final filesystem state.
-	if len(packages) == 0 && len(goBinaries) > 0 {
-		logProgress(fmt.Sprintf("checking %d executable binaries", len(goBinaries)), int64(totalLayers), int64(totalLayers))
-		packages = append(packages, detectBinaryPackages(img, goBinaries)...)
+	ctx, stop := interruptContext()
+	results := analyzeImages(ctx, buildImageJobs(ctx, opts), opts)
+	stop()
+	r := results[0]
+	if r.Err != nil {
+		log.Fatalf("%s: %v", imageLabel(r.Image, r.Platform), r.Err)
 	}
-
-	return packages
+	if err := writeSnapshot(path, r); err != nil {
+		log.Fatalf("write snapshot: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote baseline: %s (%d packages, %.2f MB installed)\n", path, r.PackageCount, r.InstalledMB)
 }
 
-// parseRPMDB parses RPM database using go-rpmdb (supports SQLite, BerkeleyDB, NDB)
-func parseRPMDB(data []byte, format string) []pkg {
-	// Write data to temp file (go-rpmdb needs file path)
-	tmpFile, err := os.CreateTemp("", "rpmdb-*")
-	if err != nil {
-		log.Printf("Warning: could not create temp file for RPM DB: %v", err)
-		return nil
+// snapshotFlags are the flags snapshot accepts besides the image
+const snapshotFlags = "--platform, --output, --languages, --lazy, --use-syft, --no-cache, --cache-ttl, --offline, --max-memory and --timeout"
+
+// checkSnapshotFlags rejects the analysis flags that have no meaning for a snapshot
+func checkSnapshotFlags(opts runOptions) error {
+	rejected := []struct {
+		flag string
+		set  bool
+	}{
+		{"--policy", opts.policyPath != ""},
+		{"--baseline", opts.baselinePath != ""},
+		{"--tolerance", opts.tolerance != ""},
+		{"--csv", opts.csvOut != ""},
+		{"--manifest-only", opts.manifestOnly},
+		{"--fail-on-change", opts.failOnChange},
 	}
-	defer func() { _ = os.Remove(tmpFile.Name()) }()
-
-	if _, err := tmpFile.Write(data); err != nil {
-		_ = tmpFile.Close()
-		log.Printf("Warning: could not write RPM DB to temp file: %v", err)
-		return nil
+	for _, r := range rejected {
+		if r.set {
+			return fmt.Errorf("%s is not supported by snapshot, which accepts %s", r.flag, snapshotFlags)
+		}
 	}
-	_ = tmpFile.Close()
+	return nil
+}
 
-	// Open RPM database
-	db, err := rpmdb.Open(tmpFile.Name())
+// writeSnapshot stores one result in the analysis JSON schema. Packages are sorted
+// by name so a committed baseline diffs cleanly when it is regenerated.
+func writeSnapshot(path string, r imageResult) (err error) {
+	report := buildJSONReport([]imageResult{r})
+	report.Report = "snapshot"
+	packages := report.Images[0].Packages
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+
+	f, err := os.Create(path)
 	if err != nil {
-		log.Printf("Warning: could not open RPM DB (%s): %v", format, err)
-		return nil
+		return err
 	}
-	defer func() { _ = db.Close() }()
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
 
-	// List packages
-	pkgList, err := db.ListPackages()
+// loadSnapshot reads a baseline written by snapshot (or a single-image analysis
+// report) back into an imageResult
+func loadSnapshot(path string) (imageResult, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("Warning: could not list RPM packages: %v", err)
-		return nil
+		return imageResult{}, err
 	}
-
-	var packages []pkg
-	for _, p := range pkgList {
-		if p.Name != "" {
-			packages = append(packages, pkg{
-				Name:    p.Name,
-				Version: fmt.Sprintf("%s-%s", p.Version, p.Release),
-				SizeKB:  int64(p.Size) / 1024,
-				Type:    "rpm",
-			})
-		}
+	var report jsonReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return imageResult{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if report.Report != "snapshot" && report.Report != "analysis" {
+		return imageResult{}, fmt.Errorf("%s: not a pkgpulse snapshot", path)
+	}
+	if report.SchemaVersion > jsonSchemaVersion {
+		return imageResult{}, fmt.Errorf("%s: schema version %d is newer than supported (%d), upgrade pkgpulse",
+			path, report.SchemaVersion, jsonSchemaVersion)
+	}
+	if len(report.Images) != 1 {
+		return imageResult{}, fmt.Errorf("%s: baseline must contain exactly one image, found %d", path, len(report.Images))
+	}
+	img := report.Images[0]
+	if img.Error != "" {
+		return imageResult{}, fmt.Errorf("%s: baseline records a failed analysis: %s", path, img.Error)
 	}
 
-	return packages
+	r := imageResult{
+		Image:        img.Image,
+		Platform:     img.Platform,
+		Digest:       img.Digest,
+		CompressedMB: img.CompressedMB,
+		InstalledMB:  img.InstalledMB,
+		PackageCount: img.PackageCount,
+		Rows:         make([]row, 0, len(img.Packages)),
+		PackageMap:   make(map[packageKey]row, len(img.Packages)),
+		Source:       "baseline",
+	}
+	for _, p := range img.Packages {
+		pr := row{Name: p.Name, Ver: p.Version, Vers: p.Versions, MB: p.InstalledMB, Type: p.Type, SizeKB: p.InstalledKB, Arch: p.Arch, License: p.License}
+		r.Rows = append(r.Rows, pr)
+		r.PackageMap[rowKey(pr)] = pr
+	}
+	sort.Slice(r.Rows, func(i, j int) bool { return r.Rows[i].MB > r.Rows[j].MB })
+	r.AllRows = r.Rows
+	return r, nil
 }
 
-// detectBinaryPackages inspects executable files and emits binary packages.
-func detectBinaryPackages(img v1.Image, candidates map[string]int64) []pkg {
-	var packages []pkg
-	seenNames := make(map[string]struct{})
+func handleCheckCommand(args []string) {
+	opts := parseRunFlags(args)
+	if opts.baselinePath == "" || len(opts.images) > 1 {
+		log.Fatalf("usage: pkgpulse check --baseline <file> [--tolerance 5%%|2MB] [flags] [<image>]")
+	}
+	if opts.allPlatforms {
+		log.Fatalf("--all-platforms is not supported by check, use --platform")
+	}
+	if opts.policyPath != "" || opts.csvOut != "" || opts.manifestOnly || opts.failOnChange {
+		log.Fatalf("--policy, --csv, --manifest-only and --fail-on-change are not supported by check")
+	}
 
-	layers, err := img.Layers()
+	tolerance, err := parseSizeTolerance(opts.tolerance)
 	if err != nil {
-		return nil
+		log.Fatalf("invalid --tolerance %q: %v", opts.tolerance, err)
+	}
+	baseline, err := loadSnapshot(opts.baselinePath)
+	if err != nil {
+		log.Fatalf("load baseline: %v", err)
 	}
 
-	// Read layers in reverse so the first match is the final file version.
-	for i := len(layers) - 1; i >= 0 && len(candidates) > 0; i-- {
-		layer := layers[i]
-		rc, err := layer.Uncompressed()
-		if err != nil {
-			continue
-		}
-
-		tr := tar.NewReader(rc)
-		for {
-			hdr, err := tr.Next()
-			if err == io.EOF {
-				break
-			}
+	// Without an image argument, re-analyze the image the baseline was taken from
+	if len(opts.images) == 0 {
+		opts.images = []string{baseline.Image}
+		if opts.platform == nil && baseline.Platform != "" {
+			p, err := v1.ParsePlatform(baseline.Platform)
 			if err != nil {
-				break
+				log.Fatalf("baseline platform %q: %v", baseline.Platform, err)
 			}
+			opts.platform = p
+		}
+	}
 
-			path := strings.TrimPrefix(hdr.Name, "/")
-			path = strings.TrimPrefix(path, "./")
-
-			size, isCandidate := candidates[path]
-			if !isCandidate {
-				continue
-			}
+	ctx, stop := interruptContext()
+	results := analyzeImages(ctx, buildImageJobs(ctx, opts), opts)
+	stop()
+	if r := results[0]; r.Err != nil {
+		log.Fatalf("%s: %v", imageLabel(r.Image, r.Platform), r.Err)
+	}
+	diff := buildImageDiff(baseline, results[0])
+	check := evaluateBaselineCheck(diff, opts.baselinePath, tolerance)
 
-			// Read binary data
-			data, err := io.ReadAll(tr)
-			if err != nil {
-				continue
-			}
+	out, closeOut := openOutput(opts.outputPath)
+	if opts.format == "json" {
+		if err := writeCheckJSON(out, diff, check, opts.tolerance); err != nil {
+			log.Fatalf("write JSON: %v", err)
+		}
+	} else {
+		displayImageDiff(out, diff)
+		displayBaselineCheck(out, check)
+	}
+	closeOut()
+	if opts.outputPath != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %s check: %s\n", opts.format, opts.outputPath)
+	}
 
-			name := filepath.Base(path)
-			version := "-"
+	if len(check.Regressions) > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d regressions against baseline %s\n", len(check.Regressions), opts.baselinePath)
+		os.Exit(exitBaselineRegression)
+	}
+}
 
-			// BusyBox applets may be named as individual commands ("[", "sh", etc.).
-			// Normalize these to a single "busybox" package when signature is present.
-			if match := busyBoxVersionRe.FindSubmatch(data); len(match) > 1 {
-				name = "busybox"
-				version = string(match[1])
-			}
+// parseSizeTolerance accepts a percentage of the baseline ("5%") or megabytes ("2", "2MB").
+// An empty string means no growth is allowed.
+func parseSizeTolerance(s string) (sizeTolerance, error) {
+	if s == "" {
+		return sizeTolerance{}, nil
+	}
+	t := sizeTolerance{}
+	numStr := s
+	if strings.HasSuffix(s, "%") {
+		t.Percent = true
+		numStr = strings.TrimSuffix(s, "%")
+	} else if len(s) > 2 && strings.EqualFold(s[len(s)-2:], "mb") {
+		numStr = s[:len(s)-2]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(numStr), 64)
+	if err != nil {
+		return sizeTolerance{}, errors.New("expected a percentage like 5% or a size in MB like 2MB")
+	}
+	if v < 0 {
+		return sizeTolerance{}, errors.New("must not be negative")
+	}
+	t.Value = v
+	return t, nil
+}
 
-			if _, exists := seenNames[name]; exists {
-				delete(candidates, path)
-				continue
-			}
-			seenNames[name] = struct{}{}
+// allowedMB converts the tolerance into MB of growth over baseMB
+func (t sizeTolerance) allowedMB(baseMB float64) float64 {
+	if t.Percent {
+		return baseMB * t.Value / 100
+	}
+	return t.Value
+}
 
-			// Try Go build info first.
-			if info, err := buildinfo.Read(bytes.NewReader(data)); err == nil {
-				version = info.GoVersion
-				if info.Main.Version != "" && info.Main.Version != "(devel)" {
-					version = info.Main.Version
-				}
-			} else if name == "getconf" {
-				// libc-bin/getconf embeds glibc version strings in binaries.
-				if match := debianGLIBCVersionRe.FindSubmatch(data); len(match) > 1 {
-					version = string(match[1])
-				} else {
-					if match := glibcSymbolVersionRe.FindSubmatch(data); len(match) > 1 {
-						version = string(match[1])
-					}
-				}
-			}
+func (t sizeTolerance) String() string {
+	if t.Percent {
+		return strconv.FormatFloat(t.Value, 'f', -1, 64) + "%"
+	}
+	return fmt.Sprintf("%.2f MB", t.Value)
+}
 
-			packages = append(packages, pkg{
-				Name:    name,
-				Version: version,
-				SizeKB:  size / 1024,
-				Type:    "binary",
+// evaluateBaselineCheck flags installed growth beyond the tolerance and every added package.
+// Removals, upgrades and shrinking are not regressions.
+func evaluateBaselineCheck(d imageDiff, baselinePath string, t sizeTolerance) baselineCheck {
+	check := baselineCheck{
+		BaselinePath:    baselinePath,
+		Tolerance:       t,
+		AllowedGrowthMB: t.allowedMB(d.Old.InstalledMB),
+		GrowthMB:        d.New.InstalledMB - d.Old.InstalledMB,
+	}
+	if check.GrowthMB > check.AllowedGrowthMB {
+		check.Regressions = append(check.Regressions, checkRegression{
+			Rule: "installed_size",
+			Message: fmt.Sprintf("installed size grew %s (%.2f MB -> %.2f MB), tolerance %s allows %s",
+				formatDeltaMB(check.GrowthMB), d.Old.InstalledMB, d.New.InstalledMB, t, formatDeltaMB(check.AllowedGrowthMB)),
+		})
+	}
+	for _, c := range d.Changes {
+		if c.Kind == changeAdded {
+			check.Regressions = append(check.Regressions, checkRegression{
+				Rule:    "new_package",
+				Message: fmt.Sprintf("new package %s %s (%.2f MB)", c.Key, c.NewVersion, c.NewMB),
 			})
-
-			// Remove from candidates so we don't process again
-			delete(candidates, path)
 		}
-		_ = rc.Close()
 	}
-
-	return packages
+	return check
 }
 
-// parseAPKDB parses Alpine's /lib/apk/db/installed format
-func parseAPKDB(data []byte) []pkg {
-	var packages []pkg
-	var current pkg
+func displayBaselineCheck(w io.Writer, c baselineCheck) {
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80)))
+	fmt.Fprintf(w, "CHECK (baseline %s)\n", c.BaselinePath)
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80))+"\n")
 
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	for scanner.Scan() {
-		line := scanner.Text()
+	fmt.Fprintf(w, "Installed growth: %s (tolerance %s allows %s)\n\n",
+		formatDeltaMB(c.GrowthMB), c.Tolerance, formatDeltaMB(c.AllowedGrowthMB))
 
-		if line == "" {
-			// End of package entry
-			if current.Name != "" {
-				packages = append(packages, current)
-			}
-			current = pkg{Type: "apk"}
-			continue
-		}
+	if len(c.Regressions) == 0 {
+		fmt.Fprintln(w, "✓ No regressions against baseline")
+		return
+	}
+	for _, r := range c.Regressions {
+		fmt.Fprintf(w, "✗ %-15s %s\n", r.Rule, r.Message)
+	}
+	fmt.Fprintf(w, "\nCheck failed: %d regressions\n", len(c.Regressions))
+}
 
-		if len(line) < 2 || line[1] != ':' {
-			continue
-		}
+func writeCheckJSON(w io.Writer, d imageDiff, c baselineCheck, toleranceArg string) error {
+	report := buildDiffJSON(d)
+	report.Report = "check"
+	if toleranceArg == "" {
+		toleranceArg = "0"
+	}
+	report.Check = &jsonCheck{
+		Baseline:          c.BaselinePath,
+		Passed:            len(c.Regressions) == 0,
+		Tolerance:         toleranceArg,
+		AllowedGrowthMB:   c.AllowedGrowthMB,
+		InstalledGrowthMB: c.GrowthMB,
+		Regressions:       make([]jsonCheckRegression, 0, len(c.Regressions)),
+	}
+	for _, r := range c.Regressions {
+		report.Check.Regressions = append(report.Check.Regressions, jsonCheckRegression{Rule: r.Rule, Message: r.Message})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
 
-		key := line[0]
-		value := line[2:]
+/* ---- Version ordering ---- */
 
-		switch key {
-		case 'P': // Package name
-			current.Name = value
-		case 'V': // Version
-			current.Version = value
-		case 'I': // Installed size (bytes)
-			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
-				current.SizeKB = size / 1024
+// comparePackageVersions orders two package versions (-1, 0, 1). Versions of the
+// same package type use that distro's rules; mixed types fall back to a generic order.
+func comparePackageVersions(typeA, a, typeB, b string) int {
+	if a == b {
+		return 0
+	}
+	if typeA != typeB {
+		return compareGenericVersions(a, b)
+	}
+	switch typeA {
+	case "deb":
+		return compareDebianVersions(a, b)
+	case "rpm", "pacman":
+		// pacman's vercmp is rpmvercmp over the same epoch:version-release layout
+		return compareRPMVersions(a, b)
+	case "apk":
+		return compareAPKVersions(a, b)
+	default:
+		return compareGenericVersions(a, b)
+	}
+}
+
+// compareGenericVersions compares digit runs numerically and everything else byte-wise
+func compareGenericVersions(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			si, sj := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
 			}
-		case 'S': // Package size (fallback if I not present)
-			if current.SizeKB == 0 {
-				if size, err := strconv.ParseInt(value, 10, 64); err == nil {
-					current.SizeKB = size / 1024
-				}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			if c := compareNumericStrings(a[si:i], b[sj:j]); c != 0 {
+				return c
 			}
+			continue
+		}
+		if a[i] != b[j] {
+			return cmp.Compare(a[i], b[j])
 		}
+		i++
+		j++
 	}
+	return cmp.Compare(len(a)-i, len(b)-j)
+}
 
-	// Don't forget last package
-	if current.Name != "" {
-		packages = append(packages, current)
+// compareNumericStrings compares arbitrarily long digit strings without overflow
+func compareNumericStrings(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return cmp.Compare(len(a), len(b))
 	}
+	return strings.Compare(a, b)
+}
 
-	return packages
+// splitEpoch splits an optional leading "epoch:" (missing epoch is 0)
+func splitEpoch(v string) (epoch, rest string) {
+	if idx := strings.IndexByte(v, ':'); idx > 0 && isAllDigits(v[:idx]) {
+		return v[:idx], v[idx+1:]
+	}
+	return "0", v
 }
 
-func combineDpkgStatusParts(parts map[string][]byte) []byte {
-	if len(parts) == 0 {
-		return nil
+// compareDebianVersions implements dpkg ordering of [epoch:]upstream[-revision]
+func compareDebianVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if c := compareNumericStrings(epochA, epochB); c != 0 {
+		return c
 	}
 
-	keys := make([]string, 0, len(parts))
-	for k := range parts {
-		keys = append(keys, k)
+	upA, revA := restA, ""
+	if idx := strings.LastIndexByte(restA, '-'); idx >= 0 {
+		upA, revA = restA[:idx], restA[idx+1:]
+	}
+	upB, revB := restB, ""
+	if idx := strings.LastIndexByte(restB, '-'); idx >= 0 {
+		upB, revB = restB[:idx], restB[idx+1:]
 	}
-	sort.Strings(keys)
 
-	var combined bytes.Buffer
-	for _, k := range keys {
-		data := parts[k]
-		if len(data) == 0 {
-			continue
+	if c := debianVerRevCmp(upA, upB); c != 0 {
+		return c
+	}
+	return debianVerRevCmp(revA, revB)
+}
+
+// debianOrder weights a non-digit character: '~' sorts before everything (even the
+// end of the string), letters before other symbols.
+func debianOrder(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	c := s[i]
+	switch {
+	case isDigit(c):
+		return 0
+	case isAlpha(c):
+		return int(c)
+	case c == '~':
+		return -1
+	default:
+		return int(c) + 256
+	}
+}
+
+// debianVerRevCmp is dpkg's verrevcmp: alternating non-digit and digit runs
+func debianVerRevCmp(a, b string) int {
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for (i < len(a) && !isDigit(a[i])) || (j < len(b) && !isDigit(b[j])) {
+			if c := cmp.Compare(debianOrder(a, i), debianOrder(b, j)); c != 0 {
+				return c
+			}
+			i++
+			j++
+		}
+		// The non-digit loop may step past the end of the shorter string
+		i, j = min(i, len(a)), min(j, len(b))
+		si, sj := i, j
+		for i < len(a) && isDigit(a[i]) {
+			i++
+		}
+		for j < len(b) && isDigit(b[j]) {
+			j++
 		}
-		combined.Write(data)
-		if !bytes.HasSuffix(data, []byte("\n")) {
-			combined.WriteByte('\n')
+		if c := compareNumericStrings(a[si:i], b[sj:j]); c != 0 {
+			return c
 		}
-		combined.WriteByte('\n')
 	}
-
-	return combined.Bytes()
+	return 0
 }
 
-// parseDpkgDB parses Debian's /var/lib/dpkg/status format.
-// If assumeInstalled is true, entries without a Status line are treated as installed.
-func parseDpkgDB(data []byte, assumeInstalled bool) []pkg {
-	var packages []pkg
-	var current pkg
-	var isInstalled bool
-	var statusSeen bool
+// compareRPMVersions orders [epoch:]version-release using rpmvercmp for each part
+func compareRPMVersions(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if c := compareNumericStrings(epochA, epochB); c != 0 {
+		return c
+	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	for scanner.Scan() {
-		line := scanner.Text()
+	verA, relA := restA, ""
+	if idx := strings.LastIndexByte(restA, '-'); idx >= 0 {
+		verA, relA = restA[:idx], restA[idx+1:]
+	}
+	verB, relB := restB, ""
+	if idx := strings.LastIndexByte(restB, '-'); idx >= 0 {
+		verB, relB = restB[:idx], restB[idx+1:]
+	}
+
+	if c := rpmVerCmp(verA, verB); c != 0 {
+		return c
+	}
+	return rpmVerCmp(relA, relB)
+}
+
+// rpmVerCmp mirrors rpm's rpmvercmp: alphanumeric segments, numeric segments newer
+// than alpha ones, '~' sorts before anything and '^' after the base version.
+func rpmVerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		for i < len(a) && !isAlnum(a[i]) && a[i] != '~' && a[i] != '^' {
+			i++
+		}
+		for j < len(b) && !isAlnum(b[j]) && b[j] != '~' && b[j] != '^' {
+			j++
+		}
 
-		if line == "" {
-			// End of package entry
-			if current.Name != "" && (isInstalled || (assumeInstalled && !statusSeen)) {
-				packages = append(packages, current)
+		// Tilde separator: the side with the tilde is older
+		tildeA := i < len(a) && a[i] == '~'
+		tildeB := j < len(b) && b[j] == '~'
+		if tildeA || tildeB {
+			if !tildeA {
+				return 1
 			}
-			current = pkg{Type: "deb"}
-			isInstalled = false
-			statusSeen = false
+			if !tildeB {
+				return -1
+			}
+			i++
+			j++
 			continue
 		}
 
-		// Handle continuation lines (start with space)
-		if strings.HasPrefix(line, " ") {
+		// Caret separator: newer than the end of the string, older than anything else
+		caretA := i < len(a) && a[i] == '^'
+		caretB := j < len(b) && b[j] == '^'
+		if caretA || caretB {
+			if i >= len(a) {
+				return -1
+			}
+			if j >= len(b) {
+				return 1
+			}
+			if !caretA {
+				return 1
+			}
+			if !caretB {
+				return -1
+			}
+			i++
+			j++
 			continue
 		}
 
-		idx := strings.Index(line, ": ")
-		if idx == -1 {
-			continue
+		if i >= len(a) || j >= len(b) {
+			break
 		}
 
-		key := line[:idx]
-		value := line[idx+2:]
+		si, sj := i, j
+		numeric := isDigit(a[i])
+		if numeric {
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+		} else {
+			for i < len(a) && isAlpha(a[i]) {
+				i++
+			}
+			for j < len(b) && isAlpha(b[j]) {
+				j++
+			}
+		}
 
-		switch key {
-		case "Package":
-			current.Name = value
-		case "Version":
-			current.Version = value
-		case "Installed-Size":
-			// dpkg stores size in KB
-			if size, err := strconv.ParseInt(value, 10, 64); err == nil {
-				current.SizeKB = size
+		// Segments of different kinds: numeric is newer
+		if sj == j {
+			if numeric {
+				return 1
 			}
-		case "Status":
-			// Only count installed packages
-			isInstalled = strings.Contains(value, "installed")
-			statusSeen = true
+			return -1
+		}
+
+		var c int
+		if numeric {
+			c = compareNumericStrings(a[si:i], b[sj:j])
+		} else {
+			c = strings.Compare(a[si:i], b[sj:j])
+		}
+		if c != 0 {
+			return c
 		}
 	}
 
-	// Don't forget last package
-	if current.Name != "" && (isInstalled || (assumeInstalled && !statusSeen)) {
-		packages = append(packages, current)
+	switch {
+	case i >= len(a) && j >= len(b):
+		return 0
+	case i < len(a):
+		return 1
+	default:
+		return -1
 	}
+}
 
-	return packages
+// apkSuffixRank orders apk version suffixes; a missing suffix ranks between _rc and _cvs
+var apkSuffixRank = map[string]int{
+	"alpha": 0, "beta": 1, "pre": 2, "rc": 3,
+	"":    4,
+	"cvs": 5, "svn": 6, "git": 7, "hg": 8, "p": 9,
 }
 
-// runSyftAndParse runs syft and parses output (fallback mode)
-func runSyftAndParse(image string) []pkg {
-	cmd := exec.Command("syft", image,
-		"--scope", "squashed",
-		"--select-catalogers", defaultCatalogers,
-		"-o", "syft-json")
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		log.Fatalf("syft failed: %v\nstderr:\n%s", err, stderr.String())
+type apkVersion struct {
+	numbers  []string // dot-separated numeric components
+	letter   byte     // optional single trailing letter (e.g. 1.2.3a)
+	suffixes []apkVersionSuffix
+	revision string // the N of -rN
+}
+
+type apkVersionSuffix struct {
+	rank   int
+	number string
+}
+
+func parseAPKVersion(v string) apkVersion {
+	var parsed apkVersion
+	if idx := strings.LastIndex(v, "-r"); idx >= 0 && isAllDigits(v[idx+2:]) {
+		parsed.revision = v[idx+2:]
+		v = v[:idx]
 	}
 
-	var sbom syftSBOM
-	if err := json.Unmarshal(out.Bytes(), &sbom); err != nil {
-		log.Fatalf("parse syft-json: %v", err)
+	parts := strings.Split(v, "_")
+	base := parts[0]
+	if n := len(base); n > 0 && isAlpha(base[n-1]) {
+		parsed.letter = base[n-1]
+		base = base[:n-1]
 	}
+	parsed.numbers = strings.Split(base, ".")
 
-	// Build file lookup map for binary packages
-	fileMap := make(map[string]int64)
-	for _, f := range sbom.Files {
-		if f.Metadata.Size > 0 {
-			fileMap[f.ID] = f.Metadata.Size
+	for _, part := range parts[1:] {
+		k := 0
+		for k < len(part) && isAlpha(part[k]) {
+			k++
 		}
+		rank, ok := apkSuffixRank[part[:k]]
+		if !ok {
+			rank = apkSuffixRank[""]
+		}
+		parsed.suffixes = append(parsed.suffixes, apkVersionSuffix{rank: rank, number: part[k:]})
 	}
+	return parsed
+}
 
-	artifactToFile := make(map[string]string)
-	for _, rel := range sbom.ArtifactRelationships {
-		if rel.Type == "evident-by" {
-			artifactToFile[rel.Parent] = rel.Child
+// compareAPKVersions implements apk-tools ordering of
+// number{.number}[letter]{_suffix[number]}[-rN]
+func compareAPKVersions(a, b string) int {
+	va, vb := parseAPKVersion(a), parseAPKVersion(b)
+
+	for k := 0; k < len(va.numbers) && k < len(vb.numbers); k++ {
+		na, nb := va.numbers[k], vb.numbers[k]
+		var c int
+		// Like apk, later components with a leading zero compare as fractions
+		if k > 0 && (strings.HasPrefix(na, "0") || strings.HasPrefix(nb, "0")) {
+			c = strings.Compare(na, nb)
+		} else {
+			c = compareNumericStrings(na, nb)
+		}
+		if c != 0 {
+			return c
 		}
 	}
+	if c := cmp.Compare(len(va.numbers), len(vb.numbers)); c != 0 {
+		return c
+	}
 
-	var packages []pkg
-	for _, a := range sbom.Artifacts {
-		var sizeKB int64
-		switch a.Type {
-		case "apk":
-			if a.Metadata.InstalledSize > 0 {
-				sizeKB = a.Metadata.InstalledSize / 1024
-			} else if a.Metadata.Size > 0 {
-				sizeKB = a.Metadata.Size / 1024
-			}
-		case "rpm":
-			if a.Metadata.Size > 0 {
-				sizeKB = a.Metadata.Size / 1024
-			}
-		case "deb":
-			if a.Metadata.InstalledSize > 0 {
-				sizeKB = a.Metadata.InstalledSize
-			}
-		case "binary":
-			if fileID, ok := artifactToFile[a.ID]; ok {
-				if fileSize, ok := fileMap[fileID]; ok {
-					sizeKB = fileSize / 1024
-				}
-			}
-		default:
-			if a.Metadata.InstalledSize > 0 {
-				sizeKB = a.Metadata.InstalledSize
-			} else if a.Metadata.Size > 0 {
-				sizeKB = a.Metadata.Size / 1024
-			}
-		}
+	if c := cmp.Compare(va.letter, vb.letter); c != 0 {
+		return c
+	}
 
-		if sizeKB > 0 {
-			packages = append(packages, pkg{
-				Name:    a.Name,
-				Version: a.Version,
-				SizeKB:  sizeKB,
-				Type:    a.Type,
-			})
+	for k := 0; k < len(va.suffixes) || k < len(vb.suffixes); k++ {
+		sa := apkVersionSuffix{rank: apkSuffixRank[""]}
+		sb := sa
+		if k < len(va.suffixes) {
+			sa = va.suffixes[k]
+		}
+		if k < len(vb.suffixes) {
+			sb = vb.suffixes[k]
+		}
+		if c := cmp.Compare(sa.rank, sb.rank); c != 0 {
+			return c
+		}
+		if c := compareNumericStrings(sa.number, sb.number); c != 0 {
+			return c
 		}
 	}
 
-	return packages
+	return compareNumericStrings(va.revision, vb.revision)
 }
 
-func displayImageBreakdown(result imageResult) {
-	fmt.Printf("Image: %s\n", result.Image)
-	fmt.Printf("Source: %s\n", result.Source)
-	if result.CompressedMB > 0 {
-		fmt.Printf("Compressed size (pull): %.2f MB\n", result.CompressedMB)
-	} else {
-		fmt.Printf("Compressed size (pull): N/A (local image)\n")
-	}
-	fmt.Printf("Installed size (on disk): %.2f MB\n", result.InstalledMB)
-	fmt.Printf("Packages: %d\n\n", result.PackageCount)
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
 
-	fmt.Println("Packages by installed size (on-disk MB):")
-	for _, r := range result.Rows {
-		fmt.Printf("  %-40s %-20s %8.2f MB\n", trunc(r.Name, 40), trunc(r.Ver, 20), r.MB)
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func isAlnum(c byte) bool { return isDigit(c) || isAlpha(c) }
+
+func isAllDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
 	}
-	fmt.Println()
+	return true
 }
 
-func displayComparisonTable(results []imageResult) {
-	pkgNames, cells := buildComparisonMatrix(results)
+func formatDeltaMB(delta float64) string {
+	return fmt.Sprintf("%+.2f MB", delta)
+}
 
-	// Summary comparison
-	fmt.Println("Summary Comparison:")
-	fmt.Printf("%-50s %8s %15s %15s %10s\n", "Image", "Source", "Compressed", "Installed", "Packages")
-	fmt.Println(string(bytes.Repeat([]byte("-"), 102)))
-	for _, r := range results {
-		compressedStr := fmt.Sprintf("%.2f MB", r.CompressedMB)
-		if r.CompressedMB == 0 {
-			compressedStr = "N/A"
-		}
-		fmt.Printf("%-50s %8s %15s %15s %10d\n",
-			trunc(r.Image, 50), r.Source, compressedStr,
-			fmt.Sprintf("%.2f MB", r.InstalledMB), r.PackageCount)
+func displayImageDiff(w io.Writer, d imageDiff) {
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80)))
+	fmt.Fprintln(w, "DIFF")
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("="), 80))+"\n")
+
+	fmt.Fprintf(w, "Old: %s\n", imageLabel(d.Old.Image, d.Old.Platform))
+	fmt.Fprintf(w, "New: %s\n\n", imageLabel(d.New.Image, d.New.Platform))
+
+	fmt.Fprintf(w, "%-12s %15s %15s %15s\n", "", "Old", "New", "Delta")
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("-"), 60)))
+	if delta, ok := d.compressedDelta(); ok {
+		fmt.Fprintf(w, "%-12s %15s %15s %15s\n", "Compressed",
+			fmt.Sprintf("%.2f MB", d.Old.CompressedMB), fmt.Sprintf("%.2f MB", d.New.CompressedMB), formatDeltaMB(delta))
+	} else {
+		fmt.Fprintf(w, "%-12s %15s %15s %15s\n", "Compressed", "N/A", "N/A", "N/A")
 	}
-	fmt.Println()
+	fmt.Fprintf(w, "%-12s %15s %15s %15s\n", "Installed",
+		fmt.Sprintf("%.2f MB", d.Old.InstalledMB), fmt.Sprintf("%.2f MB", d.New.InstalledMB),
+		formatDeltaMB(d.New.InstalledMB-d.Old.InstalledMB))
+	fmt.Fprintf(w, "%-12s %15d %15d %15s\n", "Packages",
+		d.Old.PackageCount, d.New.PackageCount, fmt.Sprintf("%+d", d.New.PackageCount-d.Old.PackageCount))
+	fmt.Fprintln(w)
+
+	counts := d.countByKind()
+	parts := make([]string, 0, len(changeKindOrder))
+	for _, kind := range changeKindOrder {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[kind], kind))
+	}
+	fmt.Fprintf(w, "Changes: %s (%d unchanged)\n\n", strings.Join(parts, ", "), d.Unchanged)
 
-	// Build header
-	fmt.Println("Package Version & Size Comparison:")
-	header := fmt.Sprintf("%-40s", "Package")
-	for i := range results {
-		header += fmt.Sprintf(" | %-18s %8s", fmt.Sprintf("Image %d Ver", i+1), "MB")
+	if len(d.Changes) == 0 {
+		fmt.Fprintln(w, "No package changes.")
+		return
 	}
-	fmt.Println(header)
-	sepWidth := 40 + len(results)*30
-	fmt.Println(string(bytes.Repeat([]byte("-"), sepWidth)))
 
-	// Display packages
-	for _, pkg := range pkgNames {
-		line := fmt.Sprintf("%-40s", trunc(pkg, 40))
-		for _, cell := range cells[pkg] {
-			if cell.Present {
-				line += fmt.Sprintf(" | %-18s %8.2f", trunc(cell.Version, 18), cell.MB)
-			} else {
-				line += fmt.Sprintf(" | %-18s %8s", "-", "-")
-			}
+	fmt.Fprintf(w, "%-13s %-40s %-20s %-20s %10s\n", "Change", "Package", "Old", "New", "Delta MB")
+	fmt.Fprintln(w, string(bytes.Repeat([]byte("-"), 107)))
+	for _, c := range d.Changes {
+		oldVer, newVer := c.OldVersion, c.NewVersion
+		if oldVer == "" {
+			oldVer = "-"
 		}
-		fmt.Println(line)
+		if newVer == "" {
+			newVer = "-"
+		}
+		fmt.Fprintf(w, "%-13s %-40s %-20s %-20s %10s\n",
+			c.Kind, trunc(c.Key.String(), 40), trunc(oldVer, 20), trunc(newVer, 20), fmt.Sprintf("%+.2f", c.NewMB-c.OldMB))
 	}
+	fmt.Fprintln(w)
+}
 
-	fmt.Println()
-	for i, r := range results {
-		fmt.Printf("Image %d: %s\n", i+1, r.Image)
+func buildDiffJSON(d imageDiff) jsonDiffReport {
+	counts := d.countByKind()
+	report := jsonDiffReport{
+		SchemaVersion: jsonSchemaVersion,
+		Report:        "diff",
+		Tool:          "pkgpulse",
+		ToolVersion:   version,
+		GeneratedAt:   time.Now().UTC(),
+		Old:           toJSONImage(d.Old),
+		New:           toJSONImage(d.New),
+		Summary: jsonDiffSummary{
+			InstalledDeltaMB:  d.New.InstalledMB - d.Old.InstalledMB,
+			PackageCountDelta: d.New.PackageCount - d.Old.PackageCount,
+			Added:             counts[changeAdded],
+			Removed:           counts[changeRemoved],
+			Upgraded:          counts[changeUpgraded],
+			Downgraded:        counts[changeDowngraded],
+			SizeChanged:       counts[changeSizeChanged],
+			Unchanged:         d.Unchanged,
+		},
+		Changes: make([]jsonPackageChange, 0, len(d.Changes)),
 	}
+	if delta, ok := d.compressedDelta(); ok {
+		report.Summary.CompressedDeltaMB = &delta
+	}
+	for _, c := range d.Changes {
+		report.Changes = append(report.Changes, jsonPackageChange{
+			Change:         c.Kind,
+			Name:           c.Key.Name,
+			Type:           c.Type,
+			OldVersion:     c.OldVersion,
+			NewVersion:     c.NewVersion,
+			OldInstalledMB: c.OldMB,
+			NewInstalledMB: c.NewMB,
+			DeltaMB:        c.NewMB - c.OldMB,
+		})
+	}
+	return report
 }
 
-func buildComparisonMatrix(results []imageResult) ([]string, map[string][]comparisonCell) {
-	allPackages := make(map[string]bool)
-	for _, result := range results {
-		for pkgName := range result.PackageMap {
-			allPackages[pkgName] = true
-		}
+func writeDiffJSON(w io.Writer, d imageDiff) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(buildDiffJSON(d))
+}
+
+func writeDiffCSV(path string, d imageDiff) (err error) {
+	f, createErr := os.Create(path)
+	if createErr != nil {
+		return createErr
 	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	w := csv.NewWriter(f)
+	defer w.Flush()
 
-	pkgNames := make([]string, 0, len(allPackages))
-	for pkgName := range allPackages {
-		pkgNames = append(pkgNames, pkgName)
+	// Summary block
+	if err := w.Write([]string{"section", "summary"}); err != nil {
+		return err
+	}
+	if err := w.Write([]string{"metric", "old", "new", "delta"}); err != nil {
+		return err
+	}
+	compressed := []string{"compressed_MB", "-", "-", "-"}
+	if delta, ok := d.compressedDelta(); ok {
+		compressed = []string{"compressed_MB",
+			fmt.Sprintf("%.2f", d.Old.CompressedMB), fmt.Sprintf("%.2f", d.New.CompressedMB), fmt.Sprintf("%+.2f", delta)}
+	}
+	summary := [][]string{
+		{"image", imageLabel(d.Old.Image, d.Old.Platform), imageLabel(d.New.Image, d.New.Platform), ""},
+		compressed,
+		{"installed_MB", fmt.Sprintf("%.2f", d.Old.InstalledMB), fmt.Sprintf("%.2f", d.New.InstalledMB),
+			fmt.Sprintf("%+.2f", d.New.InstalledMB-d.Old.InstalledMB)},
+		{"packages", strconv.Itoa(d.Old.PackageCount), strconv.Itoa(d.New.PackageCount),
+			fmt.Sprintf("%+d", d.New.PackageCount-d.Old.PackageCount)},
+	}
+	if err := w.WriteAll(summary); err != nil {
+		return err
 	}
-	sort.Strings(pkgNames)
 
-	cells := make(map[string][]comparisonCell, len(pkgNames))
-	for _, pkgName := range pkgNames {
-		rowCells := make([]comparisonCell, len(results))
-		for i, result := range results {
-			if r, found := result.PackageMap[pkgName]; found {
-				rowCells[i] = comparisonCell{
-					Version: r.Ver,
-					MB:      r.MB,
-					Present: true,
-				}
-			}
+	// Separator + changes block
+	if err := w.Write([]string{}); err != nil {
+		return err
+	}
+	if err := w.Write([]string{"section", "changes"}); err != nil {
+		return err
+	}
+	if err := w.Write([]string{"change", "package", "old_version", "new_version", "old_installed_MB", "new_installed_MB", "delta_MB"}); err != nil {
+		return err
+	}
+	for _, c := range d.Changes {
+		oldVer, newVer, oldMB, newMB := "-", "-", "-", "-"
+		if c.Kind != changeAdded {
+			oldVer, oldMB = c.OldVersion, fmt.Sprintf("%.2f", c.OldMB)
+		}
+		if c.Kind != changeRemoved {
+			newVer, newMB = c.NewVersion, fmt.Sprintf("%.2f", c.NewMB)
+		}
+		if err := w.Write([]string{c.Kind, c.Key.String(), oldVer, newVer, oldMB, newMB, fmt.Sprintf("%+.2f", c.NewMB-c.OldMB)}); err != nil {
+			return err
 		}
-		cells[pkgName] = rowCells
 	}
 
-	return pkgNames, cells
+	return w.Error()
 }
 
 func sanitizeImageColumnName(s string) string {
@@ -1506,13 +6999,14 @@ func buildCSVImageColumns(results []imageResult) []string {
 	columns := make([]string, len(results))
 	seen := make(map[string]int)
 	for i, r := range results {
-		base := sanitizeImageColumnName(r.Image)
+		label := imageLabel(r.Image, r.Platform)
+		base := sanitizeImageColumnName(label)
 		seen[base]++
 		if seen[base] == 1 {
 			columns[i] = base
 			continue
 		}
-		columns[i] = fmt.Sprintf("%s_%s", base, shortHash(r.Image, 8))
+		columns[i] = fmt.Sprintf("%s_%s", base, shortHash(label, 8))
 	}
 	return columns
 }
@@ -1562,12 +7056,18 @@ func writeComparisonCSV(path string, results []imageResult) (err error) {
 		return err
 	}
 	for _, r := range results {
+		if r.Err != nil {
+			if err := w.Write([]string{imageLabel(r.Image, r.Platform), "FAILED", "-", "-", "-"}); err != nil {
+				return err
+			}
+			continue
+		}
 		compressed := "-"
 		if r.CompressedMB > 0 {
 			compressed = fmt.Sprintf("%.2f", r.CompressedMB)
 		}
 		if err := w.Write([]string{
-			r.Image,
+			imageLabel(r.Image, r.Platform),
 			r.Source,
 			compressed,
 			fmt.Sprintf("%.2f", r.InstalledMB),
@@ -1594,10 +7094,10 @@ func writeComparisonCSV(path string, results []imageResult) (err error) {
 		return err
 	}
 
-	pkgNames, cells := buildComparisonMatrix(results)
-	for _, pkgName := range pkgNames {
-		out := []string{pkgName}
-		for _, cell := range cells[pkgName] {
+	keys, cells := buildComparisonMatrix(results)
+	for _, key := range keys {
+		out := []string{key.String()}
+		for _, cell := range cells[key] {
 			if cell.Present {
 				out = append(out, cell.Version, fmt.Sprintf("%.2f", cell.MB))
 			} else {
@@ -1612,6 +7112,53 @@ func writeComparisonCSV(path string, results []imageResult) (err error) {
 	return w.Error()
 }
 
+// writeManifestCSV writes the --manifest-only summary, one row per image
+func writeManifestCSV(path string, results []imageResult) (err error) {
+	f, createErr := os.Create(path)
+	if createErr != nil {
+		return createErr
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	w := csv.NewWriter(f)
+	defer w.Flush()
+
+	if err := w.Write([]string{"image", "source", "compressed_MB", "layers", "created", "architecture"}); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			if err := w.Write([]string{imageLabel(r.Image, r.Platform), "FAILED", "-", "-", "-", "-"}); err != nil {
+				return err
+			}
+			continue
+		}
+		compressed := "-"
+		if r.CompressedMB > 0 {
+			compressed = fmt.Sprintf("%.2f", r.CompressedMB)
+		}
+		created := "-"
+		if !r.Created.IsZero() {
+			created = r.Created.UTC().Format(time.RFC3339)
+		}
+		if err := w.Write([]string{
+			imageLabel(r.Image, r.Platform),
+			r.Source,
+			compressed,
+			strconv.Itoa(r.LayerCount),
+			created,
+			r.Architecture,
+		}); err != nil {
+			return err
+		}
+	}
+	return w.Error()
+}
+
 func trunc(s string, n int) string {
 	if len(s) <= n {
 		return s
@@ -1624,47 +7171,82 @@ func trunc(s string, n int) string {
 
 func toMB(b int64) float64 { return float64(b) / (1024.0 * 1024.0) }
 
-func check(err error) {
-	if err != nil {
-		if errors.Is(err, exec.ErrNotFound) {
-			log.Fatalf("required binary not found: %v", err)
-		}
-		log.Fatal(err)
-	}
-}
-
 func printUsage() {
 	fmt.Printf(`pkgpulse - Container image size analyzer
 
 Usage:
   pkgpulse [flags] <image-ref> [<image-ref>...]
+  pkgpulse diff [flags] <old-image> <new-image>
+  pkgpulse snapshot [flags] <image> [-o file]
+  pkgpulse check --baseline <file> [--tolerance 5%%|2MB] [flags] [<image>]
   pkgpulse cache <command>
 
 Flags:
   --help, -h        Show this help message
   --version, -v     Show version information
   --no-cache        Bypass cache, always fetch fresh from registry
+  --cache-ttl <d>   Skip registry revalidation of cached tags checked within d (e.g. 30m, 24h)
+  --offline         Never contact a registry; use cached images as-is
+  --manifest-only   Report pull size, layers, created date and architecture without pulling layers
+  --lazy            Fetch only package databases from eStargz/zstd:chunked layers (range requests)
+  --max-memory <s>  Cap on file contents buffered in memory, e.g. 64MB (default 256MB; rest spills to disk)
+  --concurrency <n> Images analyzed at once (default 5)
+  --timeout <d>     Fail an image whose analysis takes longer than d (e.g. 90s, 5m)
+  --languages <l>   Also list language packages: java, npm, python (comma-separated), or all
   --use-syft        Use syft instead of native parsing (optional fallback)
   --csv <file>      Export package data to CSV file
+  --format <fmt>    Output format: text (default) or json
+  --output, -o <f>  Write the report to a file instead of stdout
+  --platform <p>    Select platform from multi-platform images (e.g. linux/arm64)
+  --all-platforms   Analyze every platform of each image index
+  --policy <file>   Check images against a size/package policy (YAML or JSON)
+  --baseline <file> Snapshot to compare against (check only)
+  --tolerance <t>   Allowed installed growth for check, e.g. 5%% or 2MB (default 0)
+  --fail-on-change  Exit with code 5 when diff finds any changed package
 
 Cache Commands:
   pkgpulse cache list     List cached images with sizes
   pkgpulse cache clear    Remove all cached images
   pkgpulse cache rm IMG   Remove specific image from cache
+  pkgpulse cache prune [--older-than 30d] [--max-size 5GB]
+                          Remove old images, or evict least recently used ones
+  pkgpulse cache export -o bundle.tar [IMG...]
+                          Bundle cached images (default: all) for another machine
+  pkgpulse cache import bundle.tar
+                          Add a bundle's images to the cache (use with --offline)
   pkgpulse cache path     Show cache directory location
 
+Image Sources:
+  <image-ref>                    Registry image (e.g. alpine:latest)
+  oci:<dir>[:tag]                OCI image layout directory
+  docker-archive:<file>[:ref]    docker save tarball
+  dir:<path>                     Unpacked root filesystem directory
+
 Image Resolution:
-  1. Check local cache (tarballs stored in ~/.cache/pkgpulse/)
-  2. Fetch from remote registry, save to cache
+  1. Check local cache (layers stored once by digest in ~/.cache/pkgpulse/)
+  2. Revalidate cached tags with a manifest HEAD; re-fetch if the tag moved
+  3. Fetch from remote registry, save missing layers to cache
 
   Cached images enable fast parallel analysis.
-  Use --no-cache to skip cache and fetch fresh.
+  Use --no-cache to skip cache and fetch fresh, --cache-ttl to skip
+  revalidation of recently checked tags, --offline to never contact a registry.
+  Set PKGPULSE_CACHE_MAX_SIZE (e.g. 10GB) to evict least recently used
+  images after every cache write.
 
 Examples:
   # Analyze any image (uses cache if available)
   pkgpulse alpine:latest
   pkgpulse postgres:latest mysql:latest
 
+  # Analyze local images built in CI
+  pkgpulse oci:./out/layout:v1 docker-archive:./img.tar
+
+  # Shortlist base images by pull size without downloading layers
+  pkgpulse --manifest-only alpine:latest debian:12-slim ubuntu:24.04
+
+  # Compare architectures of a multi-platform image
+  pkgpulse --all-platforms alpine:latest
+
   # Force fresh fetch (bypass cache)
   pkgpulse --no-cache alpine:latest
 
@@ -1672,15 +7254,37 @@ Examples:
   pkgpulse cache list
   pkgpulse cache clear
 
+  # Show what changed between two images
+  pkgpulse diff alpine:3.19 alpine:3.20
+
   # Export to CSV
   pkgpulse alpine:latest --csv packages.csv
 
+  # Machine-readable JSON report
+  pkgpulse --format json -o report.json alpine:latest debian:12
+
+  # Fail CI when the runtime image breaks its size budget
+  pkgpulse --policy policy.yaml ghcr.io/acme/app:latest
+
+  # Record a baseline, then fail CI on growth or new packages
+  pkgpulse snapshot ghcr.io/acme/app:latest -o pkgpulse.baseline.json
+  pkgpulse check --baseline pkgpulse.baseline.json --tolerance 5%%
+
   # Auto-export CSV when comparing more than 3 images
   pkgpulse alpine:latest debian:12 ubuntu:24.04 busybox:latest
 
   # Use syft for edge cases (Rust binaries, unusual formats)
   pkgpulse --use-syft some-image:latest
 
+Exit Codes:
+  0  All images analyzed
+  1  Fatal error, or every image failed
+  2  Some images failed (results shown for the rest)
+  3  Every image analyzed, but at least one violates --policy
+  4  check found regressions against the baseline
+  5  diff --fail-on-change found changed packages
+  130  Interrupted (Ctrl-C or SIGTERM)
+
 Supported Registries:
   Works with any OCI-compliant registry (Docker Hub, GCR, ECR, GHCR, etc.)
 
@@ -1688,8 +7292,15 @@ Package Detection (all native, no external tools required):
   - APK (Alpine Linux)
   - DEB (Debian, Ubuntu)
   - RPM (RHEL, Fedora, CentOS, Oracle Linux)
+  - pacman (Arch Linux)
   - Go binaries (detected via build info)
 
+  Language packages are listed too when enabled with --languages:
+  - python (dist-info and egg-info in site-packages)
+  - npm (package.json in node_modules)
+  - java (jar, war and ear archives, with Maven coordinates)
+  e.g. --languages python,npm, or --languages all
+
 Requirements:
   - No external tools required for native mode
   - Network access to container registry
@@ -0,0 +1,1750 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/opencontainers/go-digest"
+)
+
+const testAPKDB = "P:musl\nV:1.2.5-r0\nI:700000\n\nP:busybox\nV:1.36.1-r1\nI:900000\n\n"
+
+const testAPKDBCurl = testAPKDB + "P:curl\nV:8.0-r0\nI:300000\n\n"
+
+type testFile struct {
+	name string
+	data []byte
+	mode int64 // 0644 when zero
+}
+
+func tarBytes(t *testing.T, files []testFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: cmp.Or(f.mode, 0644), Size: int64(len(f.data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func layerFromBytes(t *testing.T, data []byte) v1.Layer {
+	t.Helper()
+	l, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func plainLayer(t *testing.T, files ...testFile) mutate.Addendum {
+	return mutate.Addendum{Layer: layerFromBytes(t, tarBytes(t, files))}
+}
+
+// gzipCompressor writes the eStargz footer itself: estargz's own writer expects an empty
+// gzip stream of 51 bytes, but newer compress/gzip writes 48 and it panics
+type gzipCompressor struct {
+	*estargz.GzipCompressor
+	*estargz.GzipDecompressor
+}
+
+func (gc gzipCompressor) WriteTOCAndFooter(w io.Writer, off int64, toc *estargz.JTOC, diffHash hash.Hash) (digest.Digest, error) {
+	tocJSON, err := json.MarshalIndent(toc, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	gz := gzip.NewWriter(w)
+	gw := io.Writer(gz)
+	if diffHash != nil {
+		gw = io.MultiWriter(gz, diffHash)
+	}
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: estargz.TOCTarName, Size: int64(len(tocJSON))}); err != nil {
+		return "", err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return "", err
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+	// An empty gzip member whose extra field carries the TOC offset
+	footer := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, fmt.Sprintf("%016xSTARGZ", off)...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	if _, err := w.Write(footer); err != nil {
+		return "", err
+	}
+	return digest.FromBytes(tocJSON), nil
+}
+
+// estargzBlob builds an eStargz layer blob and returns it with its TOC digest
+func estargzBlob(t *testing.T, files ...testFile) ([]byte, string) {
+	t.Helper()
+	tb := tarBytes(t, files)
+	blob, err := estargz.Build(io.NewSectionReader(bytes.NewReader(tb), 0, int64(len(tb))),
+		estargz.WithCompression(gzipCompressor{estargz.NewGzipCompressor(), new(estargz.GzipDecompressor)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data, blob.TOCDigest().String()
+}
+
+func estargzLayer(t *testing.T, files ...testFile) mutate.Addendum {
+	data, tocDigest := estargzBlob(t, files...)
+	return mutate.Addendum{
+		Layer:       layerFromBytes(t, data),
+		Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: tocDigest},
+	}
+}
+
+// testRegistry is an in-memory registry that counts the blob bytes it serves
+type testRegistry struct {
+	host        string
+	blobBytes   atomic.Int64
+	ignoreRange bool // answer range requests with the whole blob and 200, like some proxies
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	t.Helper()
+	tr := &testRegistry{}
+	reg := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tr.ignoreRange {
+			r.Header.Del("Range")
+		}
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			w = countingResponseWriter{w, &tr.blobBytes}
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	tr.host = strings.Replace(srv.Listener.Addr().String(), "127.0.0.1", "localhost", 1)
+	return tr
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+func (tr *testRegistry) push(t *testing.T, repo string, layers ...mutate.Addendum) string {
+	t.Helper()
+	img, err := mutate.Append(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := tr.host + "/" + repo + ":1"
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(r, img); err != nil {
+		t.Fatal(err)
+	}
+	return ref
+}
+
+// analyzeTestImage runs a full analysis without the cache and returns it with the
+// progress messages it emitted
+func analyzeTestImage(t *testing.T, ref string, lazy bool) (imageResult, []string) {
+	t.Helper()
+	return analyzeTestImageWith(t, ref, runOptions{lazy: lazy})
+}
+
+// analyzeTestImageWith is analyzeTestImage with other analysis flags set
+func analyzeTestImageWith(t *testing.T, ref string, opts runOptions) (imageResult, []string) {
+	t.Helper()
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	opts.noCache = true
+	var messages []string
+	r := analyzeImage(context.Background(), ref, nil, 0, 1, func(ev progressEvent) {
+		messages = append(messages, ev.message)
+	}, opts)
+	if r.Err != nil {
+		t.Fatalf("analyze %s (lazy=%v): %v", ref, opts.lazy, r.Err)
+	}
+	return r, messages
+}
+
+func packageNames(r imageResult) []string {
+	var names []string
+	for _, row := range r.Rows {
+		names = append(names, row.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedRows(r imageResult) []row {
+	rows := slices.Clone(r.Rows)
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	return rows
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestLazyMatchesFullPull(t *testing.T) {
+	tr := newTestRegistry(t)
+	big := testFile{name: "opt/big.bin", data: randomBytes(t, 4<<20)}
+	db := func(content string) testFile { return testFile{name: "lib/apk/db/installed", data: []byte(content)} }
+
+	tests := []struct {
+		name   string
+		layers []mutate.Addendum
+		want   []string
+	}{
+		{"estargz", []mutate.Addendum{estargzLayer(t, big, db(testAPKDB))},
+			[]string{"busybox", "musl"}},
+		{"plain", []mutate.Addendum{plainLayer(t, big, db(testAPKDB))},
+			[]string{"busybox", "musl"}},
+		{"plain over estargz", []mutate.Addendum{estargzLayer(t, big, db(testAPKDB)), plainLayer(t, db(testAPKDBCurl))},
+			[]string{"busybox", "curl", "musl"}},
+		{"whiteout", []mutate.Addendum{estargzLayer(t, big, db(testAPKDB)), estargzLayer(t, testFile{name: "lib/apk/db/.wh.installed", data: nil})},
+			nil},
+		{"opaque dir replaced in same layer", []mutate.Addendum{
+			estargzLayer(t, big, db(testAPKDBCurl)),
+			estargzLayer(t, db(testAPKDB), testFile{name: "lib/apk/db/.wh..wh..opq", data: nil}),
+		}, []string{"busybox", "musl"}},
+		{"dir whiteout and new file in same layer", []mutate.Addendum{
+			estargzLayer(t, big, db(testAPKDBCurl)),
+			estargzLayer(t, testFile{name: "lib/.wh.apk", data: nil}, db(testAPKDB)),
+		}, []string{"busybox", "musl"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := tr.push(t, "lazy/"+string(rune('a'+i)), tt.layers...)
+
+			full, _ := analyzeTestImage(t, ref, false)
+			tr.blobBytes.Store(0)
+			lazy, _ := analyzeTestImage(t, ref, true)
+			served := tr.blobBytes.Load()
+
+			if got := packageNames(lazy); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("lazy packages = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(sortedRows(lazy), sortedRows(full)) {
+				t.Errorf("lazy rows %+v differ from full pull %+v", lazy.Rows, full.Rows)
+			}
+			if lazy.CompressedMB != full.CompressedMB || lazy.InstalledMB != full.InstalledMB {
+				t.Errorf("lazy sizes %.2f/%.2f MB differ from full pull %.2f/%.2f MB",
+					lazy.CompressedMB, lazy.InstalledMB, full.CompressedMB, full.InstalledMB)
+			}
+			// Only layers without a table of contents are pulled in full
+			seekable := true
+			for _, l := range tt.layers {
+				seekable = seekable && l.Annotations[estargz.TOCJSONDigestAnnotation] != ""
+			}
+			if seekable && served >= int64(len(big.data)) {
+				t.Errorf("lazy analysis fetched %d blob bytes, more than the %d byte file it should skip", served, len(big.data))
+			}
+		})
+	}
+}
+
+func TestBinariesIdentifiedWhenDatabaseRemoved(t *testing.T) {
+	tr := newTestRegistry(t)
+	busybox := testFile{name: "bin/busybox", data: []byte("\x7fELF...BusyBox v1.36.1 (2024-06-10) multi-call binary"), mode: 0755}
+	db := testFile{name: "lib/apk/db/installed", data: []byte(testAPKDB)}
+
+	tests := []struct {
+		name   string
+		layers []mutate.Addendum
+		want   []row
+	}{
+		{"database kept", []mutate.Addendum{plainLayer(t, db, busybox)},
+			[]row{{Name: "musl", Ver: "1.2.5-r0"}, {Name: "busybox", Ver: "1.36.1-r1"}}},
+		{"database removed by a later layer", []mutate.Addendum{
+			plainLayer(t, db, busybox),
+			plainLayer(t, testFile{name: "lib/apk/db/.wh.installed"}),
+		}, []row{{Name: "busybox", Ver: "1.36.1"}}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := analyzeTestImage(t, tr.push(t, "bins/"+string(rune('a'+i)), tt.layers...), false)
+			got := slices.Clone(r.AllRows)
+			sort.Slice(got, func(i, j int) bool { return got[i].Name > got[j].Name })
+			if len(got) != len(tt.want) {
+				t.Fatalf("packages = %+v, want %+v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].Name != tt.want[i].Name || got[i].Ver != tt.want[i].Ver {
+					t.Errorf("package %d = %s %s, want %s %s", i, got[i].Name, got[i].Ver, tt.want[i].Name, tt.want[i].Ver)
+				}
+			}
+		})
+	}
+}
+
+func TestLazyRegistryWithoutRangeSupport(t *testing.T) {
+	tr := newTestRegistry(t)
+	ref := tr.push(t, "lazy/norange",
+		estargzLayer(t, testFile{name: "opt/big.bin", data: randomBytes(t, 1<<20)}, testFile{name: "lib/apk/db/installed", data: []byte(testAPKDB)}))
+
+	full, _ := analyzeTestImage(t, ref, false)
+	tr.ignoreRange = true
+	lazy, messages := analyzeTestImage(t, ref, true)
+
+	if !reflect.DeepEqual(sortedRows(lazy), sortedRows(full)) {
+		t.Errorf("rows after fallback %+v differ from full pull %+v", lazy.Rows, full.Rows)
+	}
+	if !containsMessage(messages, "lazy fetch unavailable, pulling in full") {
+		t.Errorf("no fallback reported in progress messages %q", messages)
+	}
+}
+
+func TestLazyTOCDigestMismatch(t *testing.T) {
+	tr := newTestRegistry(t)
+	data, _ := estargzBlob(t, testFile{name: "lib/apk/db/installed", data: []byte(testAPKDB)})
+	_, otherDigest := estargzBlob(t, testFile{name: "lib/apk/db/installed", data: []byte(testAPKDBCurl)})
+	ref := tr.push(t, "lazy/badtoc", mutate.Addendum{
+		Layer:       layerFromBytes(t, data),
+		Annotations: map[string]string{estargz.TOCJSONDigestAnnotation: otherDigest},
+	})
+
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := remote.Image(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetcher, err := newLazyLayerFetcher(context.Background(), r, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetcher.open(manifest.Layers[0]); err == nil || !strings.Contains(err.Error(), "does not match annotation") {
+		t.Errorf("open with a wrong TOC annotation: err = %v, want a digest mismatch", err)
+	}
+
+	// The layer is pulled in full instead, and still analyzed
+	lazy, messages := analyzeTestImage(t, ref, true)
+	if got, want := packageNames(lazy), []string{"busybox", "musl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("packages = %v, want %v", got, want)
+	}
+	if !containsMessage(messages, "does not match annotation") {
+		t.Errorf("digest mismatch not reported in progress messages %q", messages)
+	}
+}
+
+func TestWalkLayerTOCVisitsWhiteoutsFirst(t *testing.T) {
+	data, _ := estargzBlob(t,
+		testFile{name: "a/file", data: []byte("x")},
+		testFile{name: "a/.wh.gone", data: nil},
+		testFile{name: "b/file", data: []byte("y")},
+		testFile{name: "b/.wh..wh..opq", data: nil},
+		testFile{name: "c/.wh.d", data: nil},
+	)
+	toc, err := estargz.Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var visited []string
+	if err := walkLayerTOC(toc, func(hdr *tar.Header, r io.Reader) {
+		if hdr.Typeflag == tar.TypeReg && hdr.Name != estargz.NoPrefetchLandmark && hdr.Name != estargz.PrefetchLandmark {
+			visited = append(visited, hdr.Name)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/.wh.gone", "b/.wh..wh..opq", "c/.wh.d", "a/file", "b/file"}
+	if !reflect.DeepEqual(visited, want) {
+		t.Errorf("visit order = %q, want %q", visited, want)
+	}
+}
+
+func TestTOCFileReaderChecksDigest(t *testing.T) {
+	data, _ := estargzBlob(t, testFile{name: "lib/apk/db/installed", data: []byte(testAPKDB)})
+	toc, err := estargz.Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent, ok := toc.Lookup("lib/apk/db/installed")
+	if !ok {
+		t.Fatal("installed database missing from TOC")
+	}
+
+	content, err := io.ReadAll(&tocFileReader{toc: toc, ent: ent, onErr: func(error) {}})
+	if err != nil || string(content) != testAPKDB {
+		t.Fatalf("read = %q, %v; want the database", content, err)
+	}
+
+	tampered := *ent
+	tampered.Digest = "sha256:" + strings.Repeat("0", 64)
+	var reported error
+	_, err = io.ReadAll(&tocFileReader{toc: toc, ent: &tampered, onErr: func(err error) { reported = err }})
+	if err == nil || reported == nil {
+		t.Errorf("read of a file not matching its TOC digest: err = %v, reported = %v; want both set", err, reported)
+	}
+}
+
+func containsMessage(messages []string, substr string) bool {
+	for _, m := range messages {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestVersionComparators(t *testing.T) {
+	tests := []struct {
+		name    string
+		compare func(a, b string) int
+		a, b    string
+		want    int
+	}{
+		{"dpkg equal", compareDebianVersions, "1.0-1", "1.0-1", 0},
+		{"dpkg missing epoch is 0", compareDebianVersions, "0:1.0", "1.0", 0},
+		{"dpkg epoch wins", compareDebianVersions, "1:1.0", "2.0", 1},
+		{"dpkg numeric segments", compareDebianVersions, "1.10", "1.9", 1},
+		{"dpkg tilde before release", compareDebianVersions, "1.0~rc1", "1.0", -1},
+		{"dpkg tilde runs", compareDebianVersions, "1.0~~", "1.0~", -1},
+		{"dpkg tildes compared", compareDebianVersions, "1.0~rc1", "1.0~rc2", -1},
+		{"dpkg letter after end", compareDebianVersions, "1.0a", "1.0", 1},
+		{"dpkg symbol after letter", compareDebianVersions, "1.0+b1", "1.0a", 1},
+		{"dpkg revision", compareDebianVersions, "1.0-1", "1.0-2", -1},
+		{"dpkg ubuntu revision", compareDebianVersions, "2.30-0ubuntu1", "2.30-0ubuntu10", -1},
+		{"dpkg hyphen in upstream", compareDebianVersions, "1.0-beta-1", "1.0-beta-2", -1},
+
+		{"rpm equal", compareRPMVersions, "6.2-1.fc39", "6.2-1.fc39", 0},
+		{"rpm leading zeros", compareRPMVersions, "2.0.01", "2.0.1", 0},
+		{"rpm epoch wins", compareRPMVersions, "1:1.0-1", "2.0-1", 1},
+		{"rpm release", compareRPMVersions, "6.2-1.fc38", "6.2-1.fc39", -1},
+		{"rpm numeric segments", compareRPMVersions, "1.10", "1.9", 1},
+		{"rpm extra segment", compareRPMVersions, "1.0", "1.0.0", -1},
+		{"rpm tilde before release", compareRPMVersions, "1.0~rc1", "1.0", -1},
+		{"rpm caret after release", compareRPMVersions, "1.0^git1", "1.0", 1},
+		{"rpm caret before next version", compareRPMVersions, "1.0^git1", "1.0.1", -1},
+		{"rpm numeric newer than alpha", compareRPMVersions, "1.0.a", "1.0.1", -1},
+		{"rpm trailing letters", compareRPMVersions, "1.0a", "1.0", 1},
+		{"rpm separators ignored", compareRPMVersions, "1_0", "1.0", 0},
+
+		{"apk equal", compareAPKVersions, "1.2.3-r0", "1.2.3-r0", 0},
+		{"apk revision", compareAPKVersions, "1.2.3-r0", "1.2.3-r1", -1},
+		{"apk revision numeric", compareAPKVersions, "1.2.3-r10", "1.2.3-r9", 1},
+		{"apk numeric segments", compareAPKVersions, "1.2.10", "1.2.9", 1},
+		{"apk extra segment", compareAPKVersions, "1.2", "1.2.1", -1},
+		{"apk letter", compareAPKVersions, "1.2.3a", "1.2.3", 1},
+		{"apk rc before release", compareAPKVersions, "1.2.3_rc1", "1.2.3", -1},
+		{"apk alpha before beta", compareAPKVersions, "1.2.3_alpha", "1.2.3_beta", -1},
+		{"apk patch after release", compareAPKVersions, "1.2.3_p1", "1.2.3", 1},
+		{"apk patch numbers", compareAPKVersions, "1.2.3_p1-r0", "1.2.3_p2-r0", -1},
+		{"apk git after rc", compareAPKVersions, "1.2.3_git20240101", "1.2.3_rc1", 1},
+		{"apk suffix before revision", compareAPKVersions, "1.2.3_p1-r0", "1.2.3-r5", 1},
+
+		{"generic numeric segments", compareGenericVersions, "1.10.0", "1.9.9", 1},
+		{"generic long numbers", compareGenericVersions, "20240101000000000001", "20240101000000000002", -1},
+		{"generic prefix", compareGenericVersions, "1.0", "1.0.1", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.compare(tt.a, tt.b); got != tt.want {
+				t.Errorf("compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := tt.compare(tt.b, tt.a); got != -tt.want {
+				t.Errorf("compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestComparePackageVersionsByType(t *testing.T) {
+	tests := []struct {
+		typeA, a, typeB, b string
+		want               int
+	}{
+		{"deb", "1.0~rc1", "deb", "1.0", -1},
+		{"rpm", "1.0~rc1", "rpm", "1.0", -1},
+		{"pacman", "1:1.0-1", "pacman", "2.0-1", 1},
+		{"apk", "1.2.3_p1", "apk", "1.2.3", 1},
+		{"python", "2.32.3", "python", "2.31.0", 1},
+		// Types differ: no ecosystem's rules apply, so digits and bytes are compared
+		{"deb", "1.0~rc1", "apk", "1.0", 1},
+	}
+	for _, tt := range tests {
+		if got := comparePackageVersions(tt.typeA, tt.a, tt.typeB, tt.b); got != tt.want {
+			t.Errorf("comparePackageVersions(%s %q, %s %q) = %d, want %d", tt.typeA, tt.a, tt.typeB, tt.b, got, tt.want)
+		}
+	}
+}
+
+// packageResult builds an analysis result holding the given packages
+func packageResult(image string, rows ...row) imageResult {
+	r := imageResult{Image: image, Rows: rows, AllRows: rows, PackageMap: map[packageKey]row{}, PackageCount: len(rows)}
+	for _, pr := range rows {
+		r.PackageMap[rowKey(pr)] = pr
+		r.InstalledMB += pr.MB
+	}
+	return r
+}
+
+func TestBuildImageDiff(t *testing.T) {
+	oldResult := packageResult("alpine:3.19",
+		row{Name: "busybox", Ver: "1.36.1-r15", Type: "apk", MB: 0.9},
+		row{Name: "musl", Ver: "1.2.4_git20230717-r4", Type: "apk", MB: 0.6},
+		row{Name: "openssl", Ver: "3.1.4-r5", Type: "apk", MB: 2},
+		row{Name: "zlib", Ver: "1.3.1-r0", Type: "apk", MB: 0.1},
+		row{Name: "ca-certificates", Ver: "20240226-r0", Type: "apk", MB: 0.7},
+		row{Name: "scanelf", Ver: "1.3.7-r2", Type: "apk", MB: 0.2},
+	)
+	newResult := packageResult("alpine:3.20",
+		row{Name: "busybox", Ver: "1.36.1-r29", Type: "apk", MB: 0.9},
+		row{Name: "musl", Ver: "1.2.5-r0", Type: "apk", MB: 0.6},
+		row{Name: "openssl", Ver: "3.1.4-r1", Type: "apk", MB: 2},
+		row{Name: "zlib", Ver: "1.3.1-r0", Type: "apk", MB: 0.1},
+		row{Name: "ca-certificates", Ver: "20240226-r0", Type: "apk", MB: 0.8},
+		row{Name: "libcrypto3", Ver: "3.3.1-r0", Type: "apk", MB: 4},
+	)
+
+	diff := buildImageDiff(oldResult, newResult)
+	want := []packageChange{
+		{Kind: changeAdded, Key: packageKey{Name: "libcrypto3"}, Type: "apk", NewVersion: "3.3.1-r0", NewMB: 4},
+		{Kind: changeRemoved, Key: packageKey{Name: "scanelf"}, Type: "apk", OldVersion: "1.3.7-r2", OldMB: 0.2},
+		{Kind: changeUpgraded, Key: packageKey{Name: "busybox"}, Type: "apk", OldVersion: "1.36.1-r15", NewVersion: "1.36.1-r29", OldMB: 0.9, NewMB: 0.9},
+		{Kind: changeUpgraded, Key: packageKey{Name: "musl"}, Type: "apk", OldVersion: "1.2.4_git20230717-r4", NewVersion: "1.2.5-r0", OldMB: 0.6, NewMB: 0.6},
+		{Kind: changeDowngraded, Key: packageKey{Name: "openssl"}, Type: "apk", OldVersion: "3.1.4-r5", NewVersion: "3.1.4-r1", OldMB: 2, NewMB: 2},
+		{Kind: changeSizeChanged, Key: packageKey{Name: "ca-certificates"}, Type: "apk", OldVersion: "20240226-r0", NewVersion: "20240226-r0", OldMB: 0.7, NewMB: 0.8},
+	}
+	if !reflect.DeepEqual(diff.Changes, want) {
+		t.Errorf("changes:\n got %+v\nwant %+v", diff.Changes, want)
+	}
+	if diff.Unchanged != 1 {
+		t.Errorf("unchanged = %d, want 1 (zlib)", diff.Unchanged)
+	}
+	counts := diff.countByKind()
+	for kind, n := range map[string]int{changeAdded: 1, changeRemoved: 1, changeUpgraded: 2, changeDowngraded: 1, changeSizeChanged: 1} {
+		if counts[kind] != n {
+			t.Errorf("%s count = %d, want %d", kind, counts[kind], n)
+		}
+	}
+
+	// Swapping the images turns every change around
+	reversed := buildImageDiff(newResult, oldResult)
+	kinds := map[string]string{}
+	for _, c := range reversed.Changes {
+		kinds[c.Key.Name] = c.Kind
+	}
+	for name, kind := range map[string]string{"libcrypto3": changeRemoved, "scanelf": changeAdded, "busybox": changeDowngraded, "openssl": changeUpgraded} {
+		if kinds[name] != kind {
+			t.Errorf("reversed %s = %q, want %q", name, kinds[name], kind)
+		}
+	}
+}
+
+func TestDiffExitCode(t *testing.T) {
+	base := packageResult("app:1", row{Name: "bash", Ver: "5.2.15-2+b2", Type: "deb", MB: 6})
+	same := packageResult("app:2", row{Name: "bash", Ver: "5.2.15-2+b2", Type: "deb", MB: 6})
+	upgraded := packageResult("app:3", row{Name: "bash", Ver: "5.2.15-2+b7", Type: "deb", MB: 6})
+
+	tests := []struct {
+		name         string
+		newResult    imageResult
+		failOnChange bool
+		want         int
+	}{
+		{"no changes", same, true, 0},
+		{"changes without flag", upgraded, false, 0},
+		{"changes with flag", upgraded, true, exitDiffChanged},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffExitCode(buildImageDiff(base, tt.newResult), tt.failOnChange); got != tt.want {
+				t.Errorf("diffExitCode = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	tests := []struct {
+		name, file, content string
+		wantErr             string // empty when the policy is valid
+	}{
+		{"yaml", "policy.yaml", "max_installed_mb: 80\nforbidden_packages: [bash, \"python3*\"]\nmin_versions:\n  openssl: 3.0.7\n", ""},
+		{"json", "policy.json", `{"max_packages": 40, "required_packages": ["ca-certificates"]}`, ""},
+		{"malformed yaml", "policy.yaml", "forbidden_packages: [bash\n", "policy.yaml: yaml:"},
+		{"malformed json", "policy.json", `{"max_packages": 40,}`, "policy.json: invalid character"},
+		{"unknown yaml key", "policy.yaml", "max_size_mb: 80\n", "field max_size_mb not found"},
+		{"unknown json key", "policy.json", `{"forbidden": ["bash"]}`, `unknown field "forbidden"`},
+		{"wrong type", "policy.yaml", "max_packages: many\n", "cannot unmarshal"},
+		{"empty", "policy.yaml", "", "policy file is empty"},
+		{"no rules", "policy.yaml", "forbidden_packages: []\n", "policy defines no rules"},
+		{"negative limit", "policy.yaml", "max_installed_mb: -1\n", "max_installed_mb must not be negative"},
+		{"empty package name", "policy.yaml", "required_packages: [\"\"]\n", "empty package name"},
+		{"bad glob", "policy.yaml", "forbidden_packages: [\"lib[ssl\"]\n", `invalid package pattern "lib[ssl"`},
+		{"empty min version", "policy.yaml", "min_versions:\n  openssl: \"\"\n", "empty version for openssl"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			p, err := loadPolicy(path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("loadPolicy: %v", err)
+				}
+				if p == nil {
+					t.Fatal("loadPolicy returned no policy")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadPolicy error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := loadPolicy(filepath.Join(t.TempDir(), "missing.yaml")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file error = %v, want not exist", err)
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	image := packageResult("debian:12",
+		row{Name: "bash", Ver: "5.2.15-2+b2", Type: "deb", MB: 6},
+		row{Name: "libssl3", Ver: "3.0.11-1~deb12u2", Type: "deb", MB: 5},
+		row{Name: "python3.11", Ver: "3.11.2-6", Type: "deb", MB: 1},
+		row{Name: "requests", Ver: "2.32.3", Vers: []string{"2.25.1", "2.32.3"}, Type: "python", MB: 0.5},
+	)
+	// A zero-size meta-package is left out of the size tables but still installed
+	image.AllRows = append(slices.Clone(image.Rows), row{Name: "python3", Ver: "3.11.2-1+b1", Type: "deb"})
+	image.CompressedMB = 30
+	failed := imageResult{Image: "missing:1", Err: errors.New("MANIFEST_UNKNOWN")}
+	unknownSize := packageResult("dir:rootfs", row{Name: "bash", Ver: "5.2.15-2+b2", Type: "deb", MB: 6})
+
+	float := func(v float64) *float64 { return &v }
+	integer := func(v int) *int { return &v }
+	tests := []struct {
+		name        string
+		policy      policy
+		result      imageResult
+		want        []string // "rule: message" of each violation
+		wantSkipped int
+	}{
+		{"within limits", policy{MaxCompressedMB: float(30), MaxInstalledMB: float(20), MaxPackages: integer(4)}, image, nil, 0},
+		{"over limits", policy{MaxCompressedMB: float(29), MaxInstalledMB: float(10), MaxPackages: integer(3)}, image, []string{
+			"max_compressed_mb: compressed size 30.00 MB exceeds 29.00 MB",
+			"max_installed_mb: installed size 12.50 MB exceeds 10.00 MB",
+			"max_packages: 4 packages exceeds 3",
+		}, 0},
+		{"compressed size unknown", policy{MaxCompressedMB: float(1)}, unknownSize, nil, 1},
+		{"forbidden", policy{ForbiddenPackages: []string{"bash", "python3*", "zsh"}}, image, []string{
+			"forbidden_packages: bash 5.2.15-2+b2 is installed",
+			"forbidden_packages: python3.11 3.11.2-6 is installed",
+			"forbidden_packages: python3 3.11.2-1+b1 is installed",
+		}, 0},
+		{"required", policy{RequiredPackages: []string{"python3", "libssl*", "ca-certificates"}}, image, []string{
+			"required_packages: ca-certificates is not installed",
+		}, 0},
+		{"min versions", policy{MinVersions: map[string]string{
+			"libssl3":  "3.0.11-1",  // ~deb12u2 sorts before the -1 revision
+			"bash":     "5.2.15-2",  // +b2 binNMU is newer
+			"requests": "2.30",      // one of two copies is older
+			"openssl":  "3.0.7",     // not installed
+			"python3*": "3.11.2-1~", // both match and are newer
+		}}, image, []string{
+			"min_versions: libssl3 3.0.11-1~deb12u2 is older than 3.0.11-1",
+			"min_versions: requests 2.25.1 is older than 2.30",
+		}, 0},
+		{"failed image", policy{RequiredPackages: []string{"bash"}}, failed, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := evaluatePolicy(tt.policy, []imageResult{tt.result})
+			if tt.result.Err != nil {
+				if len(results) != 0 {
+					t.Fatalf("failed image evaluated: %+v", results)
+				}
+				return
+			}
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			var got []string
+			for _, v := range results[0].Violations {
+				got = append(got, v.Rule+": "+v.Message)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("violations:\n got %q\nwant %q", got, tt.want)
+			}
+			if len(results[0].Skipped) != tt.wantSkipped {
+				t.Errorf("skipped = %q, want %d", results[0].Skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestParseSizeTolerance(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    sizeTolerance
+		allowed float64 // MB of growth allowed over a 200 MB baseline
+		wantErr bool
+	}{
+		{in: "", want: sizeTolerance{}, allowed: 0},
+		{in: "5%", want: sizeTolerance{Value: 5, Percent: true}, allowed: 10},
+		{in: "0.5%", want: sizeTolerance{Value: 0.5, Percent: true}, allowed: 1},
+		{in: "2", want: sizeTolerance{Value: 2}, allowed: 2},
+		{in: "2MB", want: sizeTolerance{Value: 2}, allowed: 2},
+		{in: "2.5mb", want: sizeTolerance{Value: 2.5}, allowed: 2.5},
+		{in: "3 MB", want: sizeTolerance{Value: 3}, allowed: 3},
+		{in: "MB", wantErr: true},
+		{in: "5GB", wantErr: true},
+		{in: "five%", wantErr: true},
+		{in: "-1%", wantErr: true},
+		{in: "-2MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseSizeTolerance(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSizeTolerance(%q) = %+v, want an error", tt.in, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSizeTolerance(%q): %v", tt.in, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSizeTolerance(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+			if allowed := got.allowedMB(200); allowed != tt.allowed {
+				t.Errorf("allowedMB(200) = %v, want %v", allowed, tt.allowed)
+			}
+		})
+	}
+}
+
+// snapshotTestResult is an analyzed image as analyzeImage returns it
+func snapshotTestResult() imageResult {
+	rows := []row{
+		{Name: "libssl3", Ver: "3.0.11-1~deb12u2", Type: "deb", SizeKB: 5120, MB: 5, Arch: "amd64", License: "Apache-2.0"},
+		{Name: "bash", Ver: "5.2.15-2+b2", Type: "deb", SizeKB: 2048, MB: 2, Arch: "amd64"},
+		{Name: "requests", Ver: "2.32.3", Vers: []string{"2.25.1", "2.32.3"}, Type: "python", SizeKB: 512, MB: 0.5},
+	}
+	r := imageResult{
+		Image:        "registry.example.com/app:1",
+		Platform:     "linux/amd64",
+		Digest:       "sha256:" + strings.Repeat("ab", 32),
+		CompressedMB: 3.25,
+		InstalledMB:  7.5,
+		PackageCount: len(rows),
+		Rows:         rows,
+		PackageMap:   map[packageKey]row{},
+		AllRows:      append(slices.Clone(rows), row{Name: "python3", Ver: "3.11.2-1+b1", Type: "deb"}),
+		Source:       "remote",
+	}
+	for _, pr := range rows {
+		r.PackageMap[rowKey(pr)] = pr
+	}
+	return r
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	want := snapshotTestResult()
+	path := filepath.Join(t.TempDir(), defaultBaselinePath)
+	if err := writeSnapshot(path, want); err != nil {
+		t.Fatalf("writeSnapshot: %v", err)
+	}
+	got, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatalf("loadSnapshot: %v", err)
+	}
+
+	if got.Image != want.Image || got.Platform != want.Platform || got.Digest != want.Digest ||
+		got.CompressedMB != want.CompressedMB || got.InstalledMB != want.InstalledMB || got.PackageCount != want.PackageCount {
+		t.Errorf("image fields:\n got %s %s %s %v %v %d\nwant %s %s %s %v %v %d",
+			got.Image, got.Platform, got.Digest, got.CompressedMB, got.InstalledMB, got.PackageCount,
+			want.Image, want.Platform, want.Digest, want.CompressedMB, want.InstalledMB, want.PackageCount)
+	}
+	if got.Source != "baseline" {
+		t.Errorf("source = %q, want baseline", got.Source)
+	}
+	if !reflect.DeepEqual(got.Rows, want.Rows) {
+		t.Errorf("rows:\n got %+v\nwant %+v", got.Rows, want.Rows)
+	}
+	if !reflect.DeepEqual(got.PackageMap, want.PackageMap) {
+		t.Errorf("package map:\n got %+v\nwant %+v", got.PackageMap, want.PackageMap)
+	}
+
+	// The same image checked against its own snapshot has no drift
+	diff := buildImageDiff(got, want)
+	if len(diff.Changes) != 0 {
+		t.Errorf("changes against own snapshot: %+v", diff.Changes)
+	}
+	if check := evaluateBaselineCheck(diff, path, sizeTolerance{}); len(check.Regressions) != 0 || check.GrowthMB != 0 {
+		t.Errorf("check against own snapshot: %+v", check)
+	}
+}
+
+func TestLoadSnapshotRejects(t *testing.T) {
+	valid := filepath.Join(t.TempDir(), "valid.json")
+	if err := writeSnapshot(valid, snapshotTestResult()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report jsonReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		edit    func(r *jsonReport)
+		wantErr string
+	}{
+		{"diff report", func(r *jsonReport) { r.Report = "diff" }, "not a pkgpulse snapshot"},
+		{"newer schema", func(r *jsonReport) { r.SchemaVersion = jsonSchemaVersion + 1 }, "newer than supported"},
+		{"two images", func(r *jsonReport) { r.Images = append(r.Images, r.Images[0]) }, "exactly one image, found 2"},
+		{"failed analysis", func(r *jsonReport) { r.Images[0].Error = "MANIFEST_UNKNOWN" }, "records a failed analysis"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := report
+			r.Images = slices.Clone(report.Images)
+			tt.edit(&r)
+			data, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "baseline.json")
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadSnapshot(path); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadSnapshot error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "truncated.json")
+	if err := os.WriteFile(path, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSnapshot(path); err == nil {
+		t.Error("truncated snapshot loaded")
+	}
+}
+
+func TestBaselineCheckDrift(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defaultBaselinePath)
+	if err := writeSnapshot(path, snapshotTestResult()); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := loadSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grown := func(rows ...row) imageResult {
+		r := snapshotTestResult()
+		r.Rows = append(slices.Clone(r.Rows), rows...)
+		for _, pr := range rows {
+			r.PackageMap[rowKey(pr)] = pr
+			r.InstalledMB += pr.MB
+		}
+		return r
+	}
+	upgraded := snapshotTestResult()
+	upgraded.PackageMap[packageKey{Name: "libssl3"}] = row{Name: "libssl3", Ver: "3.0.15-1~deb12u1", Type: "deb", MB: 5.5}
+	upgraded.InstalledMB += 0.5
+	shrunk := snapshotTestResult()
+	delete(shrunk.PackageMap, packageKey{Name: "bash"})
+	shrunk.InstalledMB -= 2
+
+	tests := []struct {
+		name      string
+		current   imageResult
+		tolerance string
+		want      []string // rules of the regressions
+	}{
+		{"unchanged", snapshotTestResult(), "", nil},
+		{"upgrade within percent", upgraded, "10%", nil},
+		{"upgrade beyond zero tolerance", upgraded, "", []string{"installed_size"}},
+		{"upgrade beyond MB tolerance", upgraded, "0.25MB", []string{"installed_size"}},
+		{"removal", shrunk, "", nil},
+		{"new empty package", grown(row{Name: "tzdata", Ver: "2024a-0+deb12u1", Type: "deb"}), "", []string{"new_package"}},
+		{"new package within tolerance", grown(row{Name: "curl", Ver: "7.88.1-10+deb12u7", Type: "deb", MB: 0.5}), "1MB", []string{"new_package"}},
+		{"new package beyond tolerance", grown(row{Name: "curl", Ver: "7.88.1-10+deb12u7", Type: "deb", MB: 0.5}), "5%", []string{"installed_size", "new_package"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tolerance, err := parseSizeTolerance(tt.tolerance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check := evaluateBaselineCheck(buildImageDiff(baseline, tt.current), path, tolerance)
+			var got []string
+			for _, r := range check.Regressions {
+				got = append(got, r.Rule)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("regressions = %+v, want rules %q", check.Regressions, tt.want)
+			}
+		})
+	}
+}
+
+func pacmanDesc(name, version, size string, licenses ...string) string {
+	desc := "%NAME%\n" + name + "\n\n%VERSION%\n" + version + "\n\n%DESC%\nThe " + name + " package\n\n" +
+		"%ARCH%\nx86_64\n\n%SIZE%\n" + size + "\n\n"
+	if len(licenses) > 0 {
+		desc += "%LICENSE%\n" + strings.Join(licenses, "\n") + "\n\n"
+	}
+	return desc + "%DEPENDS%\nglibc\nreadline\n\n"
+}
+
+func TestParsePacmanDesc(t *testing.T) {
+	tests := []struct {
+		name   string
+		desc   string
+		want   pkg
+		wantOK bool
+	}{
+		{"full", pacmanDesc("bash", "5.2.026-2", "9453568", "GPL-3.0-or-later"),
+			pkg{Name: "bash", Version: "5.2.026-2", SizeKB: 9232, Type: "pacman", Arch: "x86_64", License: "GPL-3.0-or-later"}, true},
+		{"epoch and several licenses", pacmanDesc("glibc", "1:2.40+r16+gaa533d58ff-2", "50331648", "GPL-2.0-or-later", "LGPL-2.1-or-later"),
+			pkg{Name: "glibc", Version: "1:2.40+r16+gaa533d58ff-2", SizeKB: 49152, Type: "pacman", Arch: "x86_64", License: "GPL-2.0-or-later AND LGPL-2.1-or-later"}, true},
+		{"CRLF line endings", strings.ReplaceAll(pacmanDesc("zlib", "1:1.3.1-2", "2048"), "\n", "\r\n"),
+			pkg{Name: "zlib", Version: "1:1.3.1-2", SizeKB: 2, Type: "pacman", Arch: "x86_64"}, true},
+		{"unparsable size", pacmanDesc("filesystem", "2024.04.07-1", "unknown"),
+			pkg{Name: "filesystem", Version: "2024.04.07-1", Type: "pacman", Arch: "x86_64"}, true},
+		{"values after a blank line are ignored", "%NAME%\nbash\n\nstray\n%VERSION%\n5.2.026-2\n",
+			pkg{Name: "bash", Version: "5.2.026-2", Type: "pacman"}, true},
+		{"no name", "%VERSION%\n1.0-1\n\n%SIZE%\n1024\n", pkg{Version: "1.0-1", SizeKB: 1, Type: "pacman"}, false},
+		{"empty", "", pkg{Type: "pacman"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parsePacmanDesc(strings.NewReader(tt.desc))
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePacmanDesc = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPacmanWhiteouts(t *testing.T) {
+	tr := newTestRegistry(t)
+	desc := func(name, version string) testFile {
+		return testFile{name: pacmanLocalDir + "/" + name + "-" + version + "/desc", data: []byte(pacmanDesc(name, version, "1048576"))}
+	}
+	files := func(name, version string) testFile {
+		return testFile{name: pacmanLocalDir + "/" + name + "-" + version + "/files", data: []byte("%FILES%\nusr/\nusr/bin/\n")}
+	}
+	whiteout := func(name string) testFile { return testFile{name: pacmanLocalDir + "/.wh." + name} }
+	base := plainLayer(t,
+		desc("glibc", "2.39+r52+gf8e4623421-1"), files("glibc", "2.39+r52+gf8e4623421-1"),
+		desc("bash", "5.2.026-2"), files("bash", "5.2.026-2"),
+		desc("pacman", "6.1.0-3"))
+
+	tests := []struct {
+		name   string
+		layers []mutate.Addendum
+		want   []string // name version of each package
+	}{
+		{"single layer", []mutate.Addendum{base},
+			[]string{"bash 5.2.026-2", "glibc 2.39+r52+gf8e4623421-1", "pacman 6.1.0-3"}},
+		{"package removed", []mutate.Addendum{base, plainLayer(t, whiteout("bash-5.2.026-2"))},
+			[]string{"glibc 2.39+r52+gf8e4623421-1", "pacman 6.1.0-3"}},
+		{"package upgraded", []mutate.Addendum{base, plainLayer(t,
+			whiteout("glibc-2.39+r52+gf8e4623421-1"), desc("glibc", "2.40+r16+gaa533d58ff-2"))},
+			[]string{"bash 5.2.026-2", "glibc 2.40+r16+gaa533d58ff-2", "pacman 6.1.0-3"}},
+		{"database replaced by an opaque directory", []mutate.Addendum{base, plainLayer(t,
+			testFile{name: pacmanLocalDir + "/.wh..wh..opq"}, desc("pacman", "6.1.0-5"))},
+			[]string{"pacman 6.1.0-5"}},
+		{"desc file removed", []mutate.Addendum{base, plainLayer(t,
+			testFile{name: pacmanLocalDir + "/bash-5.2.026-2/.wh.desc"})},
+			[]string{"glibc 2.39+r52+gf8e4623421-1", "pacman 6.1.0-3"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := analyzeTestImage(t, tr.push(t, "arch/"+string(rune('a'+i)), tt.layers...), false)
+			var got []string
+			for _, row := range sortedRows(r) {
+				if row.Type != "pacman" || row.SizeKB != 1024 {
+					t.Errorf("%s: type %q, %d KB, want pacman, 1024 KB", row.Name, row.Type, row.SizeKB)
+				}
+				got = append(got, row.Name+" "+row.Ver)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// languageRows returns the rows of the given package type by name
+func languageRows(r imageResult, typ string) map[string]row {
+	rows := make(map[string]row)
+	for _, pr := range r.AllRows {
+		if pr.Type == typ {
+			rows[pr.Name] = pr
+		}
+	}
+	return rows
+}
+
+func TestPythonPackages(t *testing.T) {
+	const site = "usr/lib/python3.12/site-packages"
+	const venv = "opt/venv/lib/python3.12/site-packages"
+	metadata := func(name, version string) []byte {
+		return []byte("Metadata-Version: 2.1\nName: " + name + "\nVersion: " + version + "\nLicense: Apache-2.0\n\n" + name + " description\n")
+	}
+	requestsMeta := metadata("requests", "2.32.3")
+	// Sizes are empty for RECORD itself and compiled files; the console script lives
+	// outside site-packages and counts at its recorded size
+	requestsRecord := []byte("requests/__init__.py,sha256=a,4096\n" +
+		"requests/api.py,sha256=b,8192\n" +
+		"requests/__pycache__/api.cpython-312.pyc,,\n" +
+		"requests-2.32.3.dist-info/METADATA,sha256=c," + fmt.Sprint(len(requestsMeta)) + "\n" +
+		"requests-2.32.3.dist-info/RECORD,,\n" +
+		"../../../bin/normalizer,sha256=d,1024\n")
+	sixInfo := metadata("six", "1.16.0")
+	sixFiles := []byte("../six.py\nPKG-INFO\n")
+	attrsInfo := metadata("attrs", "23.2.0")
+	attrsTopLevel := []byte("attr\n")
+
+	tr := newTestRegistry(t)
+	ref := tr.push(t, "py/app",
+		plainLayer(t,
+			testFile{name: site + "/requests-2.32.3.dist-info/METADATA", data: requestsMeta},
+			testFile{name: site + "/requests-2.32.3.dist-info/RECORD", data: requestsRecord},
+			testFile{name: site + "/requests-2.32.3.dist-info/INSTALLER", data: []byte("pip\n")},
+			testFile{name: site + "/requests/__init__.py", data: make([]byte, 4096)},
+			testFile{name: site + "/requests/api.py", data: make([]byte, 8192)},
+			testFile{name: site + "/requests/__pycache__/api.cpython-312.pyc", data: make([]byte, 2048)},
+			testFile{name: venv + "/requests-2.31.0.dist-info/METADATA", data: metadata("requests", "2.31.0")},
+			testFile{name: venv + "/requests-2.31.0.dist-info/RECORD", data: []byte("requests/__init__.py,sha256=e,3072\n")},
+			testFile{name: venv + "/requests/__init__.py", data: make([]byte, 3072)},
+			testFile{name: site + "/six-1.16.0-py3.12.egg-info/PKG-INFO", data: sixInfo},
+			testFile{name: site + "/six-1.16.0-py3.12.egg-info/installed-files.txt", data: sixFiles},
+			testFile{name: site + "/six.py", data: make([]byte, 5120)},
+			testFile{name: site + "/attrs-23.2.0-py3.12.egg-info/PKG-INFO", data: attrsInfo},
+			testFile{name: site + "/attrs-23.2.0-py3.12.egg-info/top_level.txt", data: attrsTopLevel},
+			testFile{name: site + "/attr/__init__.py", data: make([]byte, 6144)},
+			testFile{name: site + "/attr_extra/__init__.py", data: make([]byte, 1024)},
+			// Installed by the OS package manager, which reports them itself
+			testFile{name: site + "/PyYAML-6.0.1.dist-info/METADATA", data: metadata("PyYAML", "6.0.1")},
+			testFile{name: site + "/PyYAML-6.0.1.dist-info/INSTALLER", data: []byte("debian\n")},
+			testFile{name: "usr/lib/python3/dist-packages/certifi-2022.9.24.egg-info/PKG-INFO", data: metadata("certifi", "2022.9.24")},
+		),
+		plainLayer(t, testFile{name: site + "/requests/.wh.api.py"}),
+	)
+
+	r, _ := analyzeTestImageWith(t, ref, runOptions{languages: []string{langPython}})
+	got := languageRows(r, langPython)
+	want := map[string]row{
+		"requests": {Name: "requests", Ver: "2.32.3", Vers: []string{"2.31.0", "2.32.3"}, License: "Apache-2.0",
+			// api.py was removed by the second layer
+			SizeKB: int64(4096+2048+len(requestsMeta)+len(requestsRecord)+1024)/1024 + 3},
+		"six":   {Name: "six", Ver: "1.16.0", License: "Apache-2.0", SizeKB: int64(5120+len(sixInfo)) / 1024},
+		"attrs": {Name: "attrs", Ver: "23.2.0", License: "Apache-2.0", SizeKB: int64(6144+len(attrsInfo)+len(attrsTopLevel)) / 1024},
+	}
+	if len(got) != len(want) {
+		t.Errorf("python packages = %v, want %v", slices.Sorted(maps.Keys(got)), slices.Sorted(maps.Keys(want)))
+	}
+	for name, w := range want {
+		g := got[name]
+		if g.Ver != w.Ver || !slices.Equal(g.Vers, w.Vers) || g.SizeKB != w.SizeKB || g.License != w.License {
+			t.Errorf("%s = %s %v %d KB %q, want %s %v %d KB %q", name, g.Ver, g.Vers, g.SizeKB, g.License, w.Ver, w.Vers, w.SizeKB, w.License)
+		}
+	}
+
+	r, _ = analyzeTestImage(t, ref, false)
+	if rows := languageRows(r, langPython); len(rows) != 0 {
+		t.Errorf("python packages reported without --languages: %v", rows)
+	}
+}
+
+func TestNpmPackages(t *testing.T) {
+	manifest := func(name, version, license string) []byte {
+		return []byte(`{"name": "` + name + `", "version": "` + version + `", "license": ` + license + `}`)
+	}
+	expressJSON := manifest("express", "4.19.2", `"MIT"`)
+	debugOldJSON := manifest("debug", "2.6.9", `{"type": "MIT"}`)
+	debugJSON := manifest("debug", "4.3.4", `"MIT"`)
+	typesJSON := []byte(`{"name": "@types/node", "version": "20.11.0", "licenses": [{"type": "MIT"}, {"type": "Apache-2.0"}]}`)
+
+	tr := newTestRegistry(t)
+	ref := tr.push(t, "npm/app", plainLayer(t,
+		testFile{name: "app/node_modules/express/package.json", data: expressJSON},
+		testFile{name: "app/node_modules/express/index.js", data: make([]byte, 4096)},
+		// A nested copy counts towards itself, not the package that depends on it
+		testFile{name: "app/node_modules/express/node_modules/debug/package.json", data: debugOldJSON},
+		testFile{name: "app/node_modules/express/node_modules/debug/src/index.js", data: make([]byte, 2048)},
+		testFile{name: "app/node_modules/debug/package.json", data: debugJSON},
+		testFile{name: "app/node_modules/debug/src/index.js", data: make([]byte, 3072)},
+		testFile{name: "app/node_modules/@types/node/package.json", data: typesJSON},
+		testFile{name: "app/node_modules/@types/node/index.d.ts", data: make([]byte, 1024)},
+		testFile{name: "app/node_modules/.bin/express", data: make([]byte, 8192)},
+		testFile{name: "app/node_modules/.package-lock.json", data: []byte(`{"name": "app", "version": "1.0.0"}`)},
+		testFile{name: "app/node_modules/express/test/fixtures/package.json", data: manifest("fixture", "0.0.0", `"MIT"`)},
+		// Distro-packaged npm, reported by the OS package manager
+		testFile{name: "usr/lib/node_modules/npm/package.json", data: manifest("npm", "9.2.0", `"Artistic-2.0"`)},
+	))
+
+	r, _ := analyzeTestImageWith(t, ref, runOptions{languages: []string{langNPM}})
+	got := languageRows(r, langNPM)
+	want := map[string]row{
+		"express": {Ver: "4.19.2", License: "MIT", SizeKB: int64(4096+len(expressJSON)+len(manifest("fixture", "0.0.0", `"MIT"`))) / 1024},
+		"debug": {Ver: "4.3.4", Vers: []string{"2.6.9", "4.3.4"}, License: "MIT",
+			SizeKB: int64(2048+len(debugOldJSON))/1024 + int64(3072+len(debugJSON))/1024},
+		"@types/node": {Ver: "20.11.0", License: "MIT OR Apache-2.0", SizeKB: int64(1024+len(typesJSON)) / 1024},
+	}
+	if len(got) != len(want) {
+		t.Errorf("npm packages = %v, want %v", slices.Sorted(maps.Keys(got)), slices.Sorted(maps.Keys(want)))
+	}
+	for name, w := range want {
+		g := got[name]
+		if g.Ver != w.Ver || !slices.Equal(g.Vers, w.Vers) || g.SizeKB != w.SizeKB || g.License != w.License {
+			t.Errorf("%s = %s %v %d KB %q, want %s %v %d KB %q", name, g.Ver, g.Vers, g.SizeKB, g.License, w.Ver, w.Vers, w.SizeKB, w.License)
+		}
+	}
+}
+
+// zipBytes builds a zip archive with the given files stored uncompressed
+func zipBytes(t *testing.T, files ...testFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func pomProperties(group, artifact, version string) testFile {
+	return testFile{
+		name: "META-INF/maven/" + group + "/" + artifact + "/pom.properties",
+		data: []byte("#Created by Apache Maven 3.9.6\ngroupId=" + group + "\nartifactId=" + artifact + "\nversion=" + version + "\n"),
+	}
+}
+
+func javaManifest(lines ...string) testFile {
+	return testFile{name: "META-INF/MANIFEST.MF", data: []byte("Manifest-Version: 1.0\r\n" + strings.Join(lines, "\r\n") + "\r\n\r\nName: org/example/\r\nImplementation-Version: 9.9.9\r\n")}
+}
+
+func TestCatalogJavaArchive(t *testing.T) {
+	classes := testFile{name: "org/example/Main.class", data: make([]byte, 4096)}
+	tests := []struct {
+		name  string
+		path  string
+		files []testFile
+		want  []string // name version license of each package
+	}{
+		{"pom.properties", "app/lib/guava-33.0.0-jre.jar", []testFile{
+			javaManifest("Bundle-SymbolicName: com.google.guava", "Bundle-Version: 33.0.0.jre", "Bundle-License: Apache-2.0"),
+			pomProperties("com.google.guava", "guava", "33.0.0-jre"), classes,
+		}, []string{"com.google.guava:guava 33.0.0-jre Apache-2.0"}},
+		{"pom.properties without version", "app/lib/guava-33.0.0-jre.jar", []testFile{
+			{name: "META-INF/maven/com.google.guava/guava/pom.properties", data: []byte("groupId=com.google.guava\nartifactId=guava\n")},
+		}, []string{"com.google.guava:guava 33.0.0-jre "}},
+		{"manifest fallback", "app/lib/bundle.jar", []testFile{
+			javaManifest("Bundle-SymbolicName: org.example.bundle;singleton:=true", "Bundle-Version: 2.1.0",
+				"Bundle-License: https://www.apache.org/licenses/LICENSE-2.0"), classes,
+		}, []string{"org.example.bundle 2.1.0 "}},
+		{"manifest implementation version", "app/lib/bundle-1.0.jar", []testFile{
+			javaManifest("Implementation-Title: bundle", "Implementation-Version: 2.1.0-SNAP",
+				" SHOT", "Bundle-License: MIT"), classes,
+		}, []string{"bundle 2.1.0-SNAPSHOT MIT"}},
+		{"file name fallback", "app/lib/commons-lang3-3.14.0.jar", []testFile{classes},
+			[]string{"commons-lang3 3.14.0 "}},
+		{"file name without version", "app/lib/launcher.jar", []testFile{classes},
+			[]string{"launcher  "}},
+		{"shaded jar", "app/lib/app-1.0.0.jar", []testFile{
+			pomProperties("com.fasterxml.jackson.core", "jackson-core", "2.17.0"),
+			pomProperties("com.example", "app", "1.0.0"), classes,
+		}, []string{"com.example:app 1.0.0 "}},
+		{"nested archives", "app/app.war", []testFile{
+			pomProperties("com.example", "web", "3.0.0"),
+			{name: "WEB-INF/lib/slf4j-api-2.0.12.jar", data: zipBytes(t, pomProperties("org.slf4j", "slf4j-api", "2.0.12"), classes)},
+			{name: "WEB-INF/lib/not-a-zip.jar", data: []byte("truncated")},
+		}, []string{"com.example:web 3.0.0 ", "org.slf4j:slf4j-api 2.0.12 "}},
+		{"not an archive", "app/lib/broken.jar", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := zipBytes(t, tt.files...)
+			if tt.files == nil {
+				data = []byte("not a zip")
+			}
+			var got []string
+			for _, p := range catalogJavaArchive(tt.path, bytes.NewReader(data), int64(len(data)), int64(len(data)), 0) {
+				if p.Type != langJava {
+					t.Errorf("%s: type %q, want java", p.Name, p.Type)
+				}
+				got = append(got, p.Name+" "+p.Version+" "+p.License)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("packages = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatalogJavaArchiveSizes(t *testing.T) {
+	nested := zipBytes(t, pomProperties("org.slf4j", "slf4j-api", "2.0.12"), testFile{name: "org/slf4j/Logger.class", data: make([]byte, 20<<10)})
+	war := zipBytes(t, pomProperties("com.example", "web", "3.0.0"),
+		testFile{name: "WEB-INF/classes/Main.class", data: make([]byte, 40<<10)},
+		testFile{name: "WEB-INF/lib/slf4j-api-2.0.12.jar", data: nested})
+
+	pkgs := catalogJavaArchive("app/app.war", bytes.NewReader(war), int64(len(war)), int64(len(war)), 0)
+	if len(pkgs) != 2 {
+		t.Fatalf("packages = %+v, want the war and its jar", pkgs)
+	}
+	// Stored entries take their own size in the parent, which no longer counts them
+	if want := int64(len(nested)) / 1024; pkgs[1].SizeKB != want {
+		t.Errorf("nested jar = %d KB, want %d KB", pkgs[1].SizeKB, want)
+	}
+	if want := int64(len(war)-len(nested)) / 1024; pkgs[0].SizeKB != want {
+		t.Errorf("war = %d KB, want %d KB", pkgs[0].SizeKB, want)
+	}
+}
+
+func TestJavaPackages(t *testing.T) {
+	guava := func(version string) []byte {
+		return zipBytes(t, pomProperties("com.google.guava", "guava", version), testFile{name: "com/google/Guava.class", data: make([]byte, 8<<10)})
+	}
+	tr := newTestRegistry(t)
+	ref := tr.push(t, "java/app",
+		plainLayer(t,
+			testFile{name: "app/lib/guava-32.1.3-jre.jar", data: guava("32.1.3-jre")},
+			testFile{name: "opt/tool/lib/guava-33.0.0-jre.jar", data: guava("33.0.0-jre")},
+			testFile{name: "app/lib/removed-1.0.jar", data: zipBytes(t, testFile{name: "A.class", data: []byte("x")})},
+			// Distro-packaged, reported by the OS package manager
+			testFile{name: "usr/share/java/junit4-4.13.2.jar", data: zipBytes(t, testFile{name: "A.class", data: []byte("x")})},
+		),
+		plainLayer(t, testFile{name: "app/lib/.wh.removed-1.0.jar"}),
+	)
+
+	for _, lazy := range []bool{false, true} {
+		r, _ := analyzeTestImageWith(t, ref, runOptions{languages: []string{langJava}, lazy: lazy})
+		got := languageRows(r, langJava)
+		g, ok := got["com.google.guava:guava"]
+		if len(got) != 1 || !ok {
+			t.Fatalf("lazy=%v: java packages = %v, want guava only", lazy, slices.Sorted(maps.Keys(got)))
+		}
+		if g.Ver != "33.0.0-jre" || !slices.Equal(g.Vers, []string{"32.1.3-jre", "33.0.0-jre"}) || g.SizeKB < 16 {
+			t.Errorf("lazy=%v: guava = %s %v %d KB, want 33.0.0-jre, both versions, at least 16 KB", lazy, g.Ver, g.Vers, g.SizeKB)
+		}
+	}
+}
+
+// cacheTestImage is an image saved to the test's cache, with its blobs
+type cacheTestImage struct {
+	ref   string
+	entry cacheEntry
+	blobs map[string]int64
+}
+
+// saveCacheTestImage caches an image of the given layers as ref, last used lastUsed ago,
+// with an analysis result. Its blobs are dated an hour back, so pruning doesn't take
+// them for files written while it ran.
+func saveCacheTestImage(t *testing.T, ref string, lastUsed time.Duration, layers ...v1.Layer) cacheTestImage {
+	t.Helper()
+	img, err := mutate.AppendLayers(empty.Image, layers...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveToCache(context.Background(), ref, "", "", img, func(string) {}); err != nil {
+		t.Fatalf("save %s: %v", ref, err)
+	}
+	releaseCacheLease() // this process is done with the image
+	refPath := getCacheRefPath(ref, "")
+	entry, err := readCacheEntry(refPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.LastUsedAt = time.Now().Add(-lastUsed)
+	if err := writeCacheEntry(refPath, entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveAnalysisToCache(entry.Digest, nil, []pkg{{Name: "musl", Version: "1.2.5-r0", Type: "apk", SizeKB: 700}}); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := cacheEntryBlobs(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	for p := range blobs {
+		if err := os.Chtimes(p, hourAgo, hourAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(analysisCachePath(entry.Digest), hourAgo, hourAgo); err != nil {
+		t.Fatal(err)
+	}
+	return cacheTestImage{ref: ref, entry: entry, blobs: blobs}
+}
+
+func randomLayer(t *testing.T, size int) v1.Layer {
+	return layerFromBytes(t, tarBytes(t, []testFile{{name: "opt/data.bin", data: randomBytes(t, size)}}))
+}
+
+// checkCached fails the test unless the image's ref, blobs and analysis result are all
+// present (cached) or its ref and analysis result are gone and only shared blobs remain
+func checkCached(t *testing.T, img cacheTestImage, cached bool, shared ...v1.Layer) {
+	t.Helper()
+	sharedPaths := make(map[string]bool)
+	for _, l := range shared {
+		d, err := l.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sharedPaths[cacheBlobPath(d)] = true
+	}
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+	if got := exists(getCacheRefPath(img.ref, "")); got != cached {
+		t.Errorf("%s: ref exists = %v, want %v", img.ref, got, cached)
+	}
+	if got := exists(analysisCachePath(img.entry.Digest)); got != cached {
+		t.Errorf("%s: analysis exists = %v, want %v", img.ref, got, cached)
+	}
+	for p := range img.blobs {
+		if got := exists(p); got != (cached || sharedPaths[p]) {
+			t.Errorf("%s: blob %s exists = %v, want %v", img.ref, filepath.Base(p), got, cached || sharedPaths[p])
+		}
+	}
+}
+
+func removedRefs(removed []cacheEntry) []string {
+	var refs []string
+	for _, e := range removed {
+		refs = append(refs, e.ImageRef)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+func TestPruneCacheByAge(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	base := randomLayer(t, 64<<10)
+	stale := saveCacheTestImage(t, "registry.example.com/app:1", 48*time.Hour, base, randomLayer(t, 32<<10))
+	recent := saveCacheTestImage(t, "registry.example.com/app:2", time.Hour, base, randomLayer(t, 32<<10))
+
+	removed, err := pruneCache(24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("pruneCache: %v", err)
+	}
+	if got := removedRefs(removed); !slices.Equal(got, []string{stale.ref}) {
+		t.Errorf("removed %q, want %q", got, stale.ref)
+	}
+	checkCached(t, stale, false, base)
+	checkCached(t, recent, true)
+
+	// Nothing else is old enough
+	if removed, err := pruneCache(24*time.Hour, 0); err != nil || len(removed) != 0 {
+		t.Errorf("second prune removed %q, %v", removedRefs(removed), err)
+	}
+}
+
+func TestPruneCacheBySize(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	base := randomLayer(t, 256<<10)
+	oldest := saveCacheTestImage(t, "registry.example.com/app:1", 3*time.Hour, base, randomLayer(t, 128<<10))
+	older := saveCacheTestImage(t, "registry.example.com/app:2", 2*time.Hour, base, randomLayer(t, 128<<10))
+	newest := saveCacheTestImage(t, "registry.example.com/app:3", time.Hour, base, randomLayer(t, 128<<10))
+
+	// Shared blobs count once; evicting the two least recently used images frees
+	// only their own layers, manifests and configs
+	usage := make(map[string]int64)
+	for _, img := range []cacheTestImage{oldest, older, newest} {
+		maps.Copy(usage, img.blobs)
+	}
+	var total int64
+	for _, size := range usage {
+		total += size
+	}
+	var newestSize int64
+	for _, size := range newest.blobs {
+		newestSize += size
+	}
+	limit := newestSize + (total-newestSize)/4 // room for the newest image only
+
+	removed, err := pruneCache(0, limit)
+	if err != nil {
+		t.Fatalf("pruneCache: %v", err)
+	}
+	if got := removedRefs(removed); !slices.Equal(got, []string{oldest.ref, older.ref}) {
+		t.Errorf("removed %q, want %q and %q", got, oldest.ref, older.ref)
+	}
+	checkCached(t, oldest, false, base)
+	checkCached(t, older, false, base)
+	checkCached(t, newest, true)
+
+	if removed, err := pruneCache(0, newestSize); err != nil || len(removed) != 0 {
+		t.Errorf("prune at the current size removed %q, %v", removedRefs(removed), err)
+	}
+}
+
+func TestPruneCacheKeepsLeasedBlobs(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	leased := saveCacheTestImage(t, "registry.example.com/app:1", 48*time.Hour, randomLayer(t, 32<<10))
+	stale := saveCacheTestImage(t, "registry.example.com/app:2", 48*time.Hour, randomLayer(t, 32<<10))
+
+	// A blob being imported is leased before the ref naming it exists
+	importing := randomBytes(t, 4<<10)
+	importDigest, _, err := v1.SHA256(bytes.NewReader(importing))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan := randomBytes(t, 4<<10)
+	orphanDigest, _, err := v1.SHA256(bytes.NewReader(orphan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourAgo := time.Now().Add(-time.Hour)
+	for h, data := range map[v1.Hash][]byte{importDigest: importing, orphanDigest: orphan} {
+		if err := os.WriteFile(cacheBlobPath(h), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(cacheBlobPath(h), hourAgo, hourAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	leasedDigest, err := v1.NewHash(leased.entry.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	markCacheDigestInUse(leasedDigest)
+	markCacheDigestInUse(importDigest)
+	t.Cleanup(releaseCacheLease)
+
+	removed, err := pruneCache(24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("pruneCache: %v", err)
+	}
+	if got := removedRefs(removed); !slices.Equal(got, []string{stale.ref}) {
+		t.Errorf("removed %q, want %q", got, stale.ref)
+	}
+	checkCached(t, leased, true)
+	checkCached(t, stale, false)
+	if _, err := os.Stat(cacheBlobPath(importDigest)); err != nil {
+		t.Errorf("leased import blob removed: %v", err)
+	}
+	if _, err := os.Stat(cacheBlobPath(orphanDigest)); !os.IsNotExist(err) {
+		t.Errorf("unreferenced blob kept: %v", err)
+	}
+
+	// Once the lease is released the image can go
+	releaseCacheLease()
+	removed, err = pruneCache(24*time.Hour, 0)
+	if err != nil {
+		t.Fatalf("pruneCache: %v", err)
+	}
+	if got := removedRefs(removed); !slices.Equal(got, []string{leased.ref}) {
+		t.Errorf("removed %q after release, want %q", got, leased.ref)
+	}
+	checkCached(t, leased, false)
+	if _, err := os.Stat(cacheBlobPath(importDigest)); !os.IsNotExist(err) {
+		t.Errorf("released import blob kept: %v", err)
+	}
+}
+
+func TestCacheExportImportOffline(t *testing.T) {
+	tr := newTestRegistry(t)
+	ref := tr.push(t, "app/exported", plainLayer(t,
+		testFile{name: "lib/apk/db/installed", data: []byte(testAPKDBCurl)},
+		testFile{name: "opt/data.bin", data: randomBytes(t, 64<<10)}))
+	analyze := func(opts runOptions) imageResult {
+		t.Helper()
+		r := analyzeImage(context.Background(), ref, nil, 0, 1, func(progressEvent) {}, opts)
+		releaseCacheLease()
+		if r.Err != nil {
+			t.Fatalf("analyze %s: %v", ref, r.Err)
+		}
+		return r
+	}
+
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	online := analyze(runOptions{})
+	entries, err := listCache()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("cached entries = %+v, %v, want one", entries, err)
+	}
+	var bundle bytes.Buffer
+	if err := exportCache(&bundle, entries); err != nil {
+		t.Fatalf("exportCache: %v", err)
+	}
+
+	// Another machine's cache, with no way to reach the registry
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	served := tr.blobBytes.Load()
+	imported, skipped, kept, err := importCache(bytes.NewReader(bundle.Bytes()))
+	releaseCacheLease()
+	if err != nil {
+		t.Fatalf("importCache: %v", err)
+	}
+	if len(imported) != 1 || len(skipped) != 0 || len(kept) != 0 {
+		t.Fatalf("imported %d, skipped %d, kept %d, want 1 imported", len(imported), len(skipped), len(kept))
+	}
+	if got := imported[0]; got.ImageRef != ref || got.Digest != entries[0].Digest {
+		t.Errorf("imported %s %s, want %s %s", got.ImageRef, got.Digest, ref, entries[0].Digest)
+	}
+
+	offline := analyze(runOptions{offline: true})
+	// Without the exported analysis result the packages are parsed from the imported blobs
+	if err := os.RemoveAll(filepath.Join(getCacheDir(), "analysis")); err != nil {
+		t.Fatal(err)
+	}
+	parsed := analyze(runOptions{offline: true})
+
+	for _, r := range []imageResult{offline, parsed} {
+		if r.Source != "cached (stale)" {
+			t.Errorf("source = %q, want cached (stale)", r.Source)
+		}
+		if r.Digest != online.Digest || r.CompressedMB != online.CompressedMB {
+			t.Errorf("digest %s, %v MB, want %s, %v MB", r.Digest, r.CompressedMB, online.Digest, online.CompressedMB)
+		}
+		if !reflect.DeepEqual(sortedRows(r), sortedRows(online)) {
+			t.Errorf("rows %+v differ from the online analysis %+v", r.Rows, online.Rows)
+		}
+	}
+	if n := tr.blobBytes.Load() - served; n != 0 {
+		t.Errorf("offline analysis fetched %d blob bytes", n)
+	}
+
+	// Importing again keeps the entry already there
+	imported, _, kept, err = importCache(bytes.NewReader(bundle.Bytes()))
+	releaseCacheLease()
+	if err != nil || len(imported) != 0 || len(kept) != 1 {
+		t.Errorf("second import: imported %d, kept %d, %v, want the entry kept", len(imported), len(kept), err)
+	}
+}
+
+func TestComparisonMatrixKeysByEcosystem(t *testing.T) {
+	alpine := packageResult("python:3.12-alpine",
+		row{Name: "py3-six", Ver: "1.16.0-r9", Type: "apk", MB: 0.1},
+		row{Name: "six", Ver: "1.16.0-r9", Type: "apk", MB: 0.1},
+		row{Name: "six", Ver: "1.16.0", Type: langPython, MB: 0.2},
+		row{Name: "debug", Ver: "4.3.4", Type: langNPM, MB: 0.1},
+	)
+	debian := packageResult("python:3.12-slim",
+		row{Name: "six", Ver: "1.16.0-4", Type: "deb", MB: 0.1},
+		row{Name: "six", Ver: "1.17.0", Type: langPython, MB: 0.2},
+		row{Name: "debug", Ver: "1:4.3.4+~cs4.1.7-1", Type: "deb", MB: 0.1},
+	)
+	if len(alpine.PackageMap) != 4 {
+		t.Fatalf("package map = %+v, want the apk and python six apart", alpine.PackageMap)
+	}
+
+	keys, cells := buildComparisonMatrix([]imageResult{alpine, debian})
+	var got []string
+	for _, key := range keys {
+		line := key.String()
+		for _, cell := range cells[key] {
+			line += " | " + cmp.Or(cell.Type, "-")
+		}
+		got = append(got, line)
+	}
+	// OS packages of different distros share a row; language packages have their own
+	want := []string{
+		"debug | - | deb",
+		"debug (npm) | npm | -",
+		"py3-six | apk | -",
+		"six | apk | deb",
+		"six (python) | python | python",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("matrix rows:\n got %q\nwant %q", got, want)
+	}
+
+	diff := buildImageDiff(alpine, debian)
+	kinds := map[string]string{}
+	for _, c := range diff.Changes {
+		kinds[c.Key.String()] = c.Kind
+	}
+	delete(kinds, "six") // versions of different distros are only compared generically
+	wantKinds := map[string]string{
+		"debug":        changeAdded,
+		"debug (npm)":  changeRemoved,
+		"py3-six":      changeRemoved,
+		"six (python)": changeUpgraded,
+	}
+	if !maps.Equal(kinds, wantKinds) {
+		t.Errorf("changes = %v, want %v", kinds, wantKinds)
+	}
+}
+
+func TestSelectOCILayoutManifest(t *testing.T) {
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(refName string, platform *v1.Platform) v1.Hash {
+		t.Helper()
+		img, err := mutate.AppendLayers(empty.Image, randomLayer(t, 1<<10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := []layout.Option{layout.WithAnnotations(map[string]string{ociRefNameAnnotation: refName})}
+		if platform != nil {
+			opts = append(opts, layout.WithPlatform(*platform))
+		}
+		if err := p.AppendImage(img, opts...); err != nil {
+			t.Fatal(err)
+		}
+		d, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	amd64 := &v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	registryApp := add("registry.example.com/app:1.0", nil)
+	localApp := add("app:1.0", nil)
+	mirrorApp := add("mirror.example.com/app:2.0", nil)
+	otherApp := add("registry.example.com/app:2.0", nil)
+	toolAMD := add("registry.example.com/tool:1.0", amd64)
+	toolARM := add("registry.example.com/tool:1.0", arm64)
+
+	tests := []struct {
+		tag      string
+		platform *v1.Platform
+		want     v1.Hash
+		wantErr  string
+	}{
+		{tag: "registry.example.com/app:1.0", want: registryApp},
+		{tag: "app:1.0", want: localApp},
+		{tag: "1.0", wantErr: `tag "1.0" matches 4 manifests`},
+		{tag: "2.0", wantErr: "mirror.example.com/app:2.0 (" + mirrorApp.String() + "), registry.example.com/app:2.0 (" + otherApp.String() + ")"},
+		{tag: "registry.example.com/tool:1.0", wantErr: "registry.example.com/tool:1.0 (" + toolARM.String() + ", linux/arm64)"},
+		{tag: "registry.example.com/tool:1.0", platform: arm64, want: toolARM},
+		{tag: "registry.example.com/tool:1.0", platform: amd64, want: toolAMD},
+		{tag: "3.0", wantErr: `no manifest tagged "3.0"`},
+		{tag: "", wantErr: "contains 6 manifests"},
+	}
+	for _, tt := range tests {
+		_, desc, err := selectOCILayoutManifest(dir, tt.tag, tt.platform)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("select %q (%v): error %v, want it to contain %q", tt.tag, tt.platform, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("select %q (%v): %v", tt.tag, tt.platform, err)
+		} else if desc.Digest != tt.want {
+			t.Errorf("select %q (%v) = %s, want %s", tt.tag, tt.platform, desc.Digest, tt.want)
+		}
+	}
+}
+
+func TestCheckSnapshotFlags(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr string // the rejected flag, empty when accepted
+	}{
+		{[]string{"app:1", "--platform", "linux/arm64", "-o", "base.json", "--languages", "all", "--lazy", "--timeout", "5m"}, ""},
+		{[]string{"app:1", "--offline", "--cache-ttl", "1h", "--max-memory", "64MB"}, ""},
+		{[]string{"app:1", "--use-syft", "--no-cache"}, ""},
+		{[]string{"app:1", "--policy", "policy.yaml"}, "--policy"},
+		{[]string{"app:1", "--baseline", "base.json"}, "--baseline"},
+		{[]string{"app:1", "--tolerance", "5%"}, "--tolerance"},
+		{[]string{"app:1", "--csv", "out.csv"}, "--csv"},
+		{[]string{"app:1", "--manifest-only"}, "--manifest-only"},
+		{[]string{"app:1", "--fail-on-change"}, "--fail-on-change"},
+	}
+	for _, tt := range tests {
+		err := checkSnapshotFlags(parseRunFlags(tt.args))
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%q: %v", tt.args, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr+" is not supported by snapshot") || !strings.Contains(err.Error(), snapshotFlags) {
+			t.Errorf("%q: error %v, want %s rejected with the supported flags", tt.args, err, tt.wantErr)
+		}
+	}
+}